@@ -0,0 +1,253 @@
+package nsqm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rspTopicPrefix prefix of all reply topics created by NewRpcClient.
+const rspTopicPrefix = "z...rsp-"
+
+// DefaultCleanupRecheck default interval between two observations of the
+// orphaned reply topic, twice go-nsq default LookupdPollInterval.
+var DefaultCleanupRecheck = 2 * time.Minute
+
+// ReplyTopicCleaner finds and deletes orphaned reply topics.
+// Reply topic is orphaned when none of its channels has connected client,
+// which happens when rpc client dies (or is stopped) and leaves its
+// (non-ephemeral) reply topic in nsqd.
+// Topic of the starting client may be seen without channels (or clients)
+// for a moment, so topic is deleted only if it is orphaned in two
+// observations Recheck apart.
+// Uses nsqlookupd and nsqd http api.
+type ReplyTopicCleaner struct {
+	// NSQLookupdHTTPAddresses used for finding nsqd nodes.
+	NSQLookupdHTTPAddresses []string
+	// NSQDHTTPAddresses nsqd nodes to check in addition to the ones found in lookupds.
+	NSQDHTTPAddresses []string
+	// DryRun only finds orphaned topics without deleting them.
+	DryRun bool
+	// HTTPClient default http.DefaultClient.
+	HTTPClient *http.Client
+	// Recheck interval between two observations, default DefaultCleanupRecheck.
+	// Reply topic which appears on the new nsqd has no channels until client
+	// consumer finds it in lookupd, which can take up to the consumer
+	// LookupdPollInterval (go-nsq default 60s). Recheck must be well over
+	// the largest LookupdPollInterval of the rpc clients, otherwise live
+	// reply topics are deleted with their buffered replies.
+	Recheck time.Duration
+	// after used for waiting between observations, time.After in production.
+	after func(time.Duration) <-chan time.Time
+}
+
+// Cleanup finds orphaned reply topics and deletes them from nsqds and nsqlookupds.
+// Returns names of the orphaned topics.
+// Blocks for Recheck between two observations.
+func (c *ReplyTopicCleaner) Cleanup(ctx context.Context) ([]string, error) {
+	nsqds, err := c.nsqds(ctx)
+	if err != nil {
+		return nil, err
+	}
+	first, err := c.orphaned(ctx, nsqds)
+	if err != nil || len(first) == 0 {
+		return nil, err
+	}
+	recheck := c.Recheck
+	if recheck <= 0 {
+		recheck = DefaultCleanupRecheck
+	}
+	after := c.after
+	if after == nil {
+		after = time.After
+	}
+	select {
+	case <-after(recheck):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	second, err := c.orphaned(ctx, nsqds)
+	if err != nil {
+		return nil, err
+	}
+	// orphaned in both observations
+	var topics []string
+	for t := range second {
+		if first[t] {
+			topics = append(topics, t)
+		}
+	}
+	sort.Strings(topics)
+	if c.DryRun {
+		return topics, nil
+	}
+	for _, t := range topics {
+		for _, addr := range c.NSQLookupdHTTPAddresses {
+			if err := c.deleteTopic(ctx, addr, t); err != nil {
+				return nil, err
+			}
+		}
+		for _, addr := range nsqds {
+			if err := c.deleteTopic(ctx, addr, t); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return topics, nil
+}
+
+// orphaned returns reply topics without clients on any of the nsqds.
+func (c *ReplyTopicCleaner) orphaned(ctx context.Context, nsqds []string) (map[string]bool, error) {
+	orphaned := make(map[string]bool)
+	for _, addr := range nsqds {
+		var stats nsqdStats
+		if err := c.get(ctx, addr, "/stats?format=json", &stats); err != nil {
+			return nil, err
+		}
+		for _, t := range stats.topics() {
+			if !strings.HasPrefix(t.TopicName, rspTopicPrefix) {
+				continue
+			}
+			if _, seen := orphaned[t.TopicName]; !seen {
+				orphaned[t.TopicName] = true
+			}
+			if t.hasClients() {
+				orphaned[t.TopicName] = false
+			}
+		}
+	}
+	for t, ok := range orphaned {
+		if !ok {
+			delete(orphaned, t)
+		}
+	}
+	return orphaned, nil
+}
+
+// nsqds returns http addresses of all nsqd nodes.
+func (c *ReplyTopicCleaner) nsqds(ctx context.Context) ([]string, error) {
+	seen := make(map[string]bool)
+	var addrs []string
+	add := func(addr string) {
+		if !seen[addr] {
+			seen[addr] = true
+			addrs = append(addrs, addr)
+		}
+	}
+	for _, addr := range c.NSQDHTTPAddresses {
+		add(addr)
+	}
+	for _, lookupd := range c.NSQLookupdHTTPAddresses {
+		var nodes lookupdNodes
+		if err := c.get(ctx, lookupd, "/nodes", &nodes); err != nil {
+			return nil, err
+		}
+		for _, p := range nodes.producers() {
+			add(net.JoinHostPort(p.BroadcastAddress, strconv.Itoa(p.HTTPPort)))
+		}
+	}
+	return addrs, nil
+}
+
+func (c *ReplyTopicCleaner) deleteTopic(ctx context.Context, addr, topic string) error {
+	u := fmt.Sprintf("http://%s/topic/delete?topic=%s", addr, url.QueryEscape(topic))
+	req, err := http.NewRequest(http.MethodPost, u, nil)
+	if err != nil {
+		return err
+	}
+	rsp, err := c.do(ctx, req)
+	if err != nil {
+		return err
+	}
+	rsp.Body.Close()
+	// topic may be already deleted on that node
+	if rsp.StatusCode != http.StatusOK && rsp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("delete topic %s on %s failed: %s", topic, addr, rsp.Status)
+	}
+	return nil
+}
+
+func (c *ReplyTopicCleaner) get(ctx context.Context, addr, path string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, "http://"+addr+path, nil)
+	if err != nil {
+		return err
+	}
+	rsp, err := c.do(ctx, req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return fmt.Errorf("get %s%s failed: %s", addr, path, rsp.Status)
+	}
+	return json.NewDecoder(rsp.Body).Decode(v)
+}
+
+func (c *ReplyTopicCleaner) do(ctx context.Context, req *http.Request) (*http.Response, error) {
+	// ask for unwrapped v1 responses
+	req.Header.Set("Accept", "application/vnd.nsq; version=1.0")
+	cli := c.HTTPClient
+	if cli == nil {
+		cli = http.DefaultClient
+	}
+	return cli.Do(req.WithContext(ctx))
+}
+
+// lookupdNodes nsqlookupd /nodes response.
+// Older versions wrap response into data attribute.
+type lookupdNodes struct {
+	Producers []lookupdProducer `json:"producers"`
+	Data      struct {
+		Producers []lookupdProducer `json:"producers"`
+	} `json:"data"`
+}
+
+type lookupdProducer struct {
+	BroadcastAddress string `json:"broadcast_address"`
+	HTTPPort         int    `json:"http_port"`
+}
+
+func (n lookupdNodes) producers() []lookupdProducer {
+	if len(n.Producers) > 0 {
+		return n.Producers
+	}
+	return n.Data.Producers
+}
+
+// nsqdStats nsqd /stats response.
+type nsqdStats struct {
+	Topics []nsqdTopic `json:"topics"`
+	Data   struct {
+		Topics []nsqdTopic `json:"topics"`
+	} `json:"data"`
+}
+
+type nsqdTopic struct {
+	TopicName string `json:"topic_name"`
+	Channels  []struct {
+		Clients []json.RawMessage `json:"clients"`
+	} `json:"channels"`
+}
+
+func (s nsqdStats) topics() []nsqdTopic {
+	if len(s.Topics) > 0 {
+		return s.Topics
+	}
+	return s.Data.Topics
+}
+
+func (t nsqdTopic) hasClients() bool {
+	for _, c := range t.Channels {
+		if len(c.Clients) > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,126 @@
+package nsqm
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	nsq "github.com/nsqio/go-nsq"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplyTopicCleaner(t *testing.T) {
+	var deleted []string
+	var mu sync.Mutex
+	observations := 0
+	nsqd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/stats":
+			mu.Lock()
+			observations++
+			// starting client subscribes to its reply topic after the first observation
+			starting := `{"topic_name":"z...rsp-app-node03-33333333","channels":[]}`
+			if observations%2 == 0 {
+				starting = `{"topic_name":"z...rsp-app-node03-33333333","channels":[{"clients":[{"hostname":"node03"}]}]}`
+			}
+			mu.Unlock()
+			fmt.Fprintf(w, `{"topics":[
+				{"topic_name":"z...rsp-app-node01-0a1b2c3d","channels":[{"clients":[]}]},
+				{"topic_name":"z...rsp-app-node01-11111111","channels":[{"clients":[{"hostname":"node01"}]}]},
+				{"topic_name":"z...rsp-app-node02-22222222","channels":[]},
+				%s,
+				{"topic_name":"service.req","channels":[{"clients":[]}]}
+			]}`, starting)
+		case "/topic/delete":
+			mu.Lock()
+			deleted = append(deleted, r.URL.Query().Get("topic"))
+			mu.Unlock()
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer nsqd.Close()
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(nsqd.URL, "http://"))
+	lookupd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/nodes" {
+			// legacy wrapped response
+			fmt.Fprintf(w, `{"status_code":200,"data":{"producers":[{"broadcast_address":"%s","http_port":%s}]}}`, host, port)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer lookupd.Close()
+
+	c := &ReplyTopicCleaner{
+		NSQLookupdHTTPAddresses: []string{strings.TrimPrefix(lookupd.URL, "http://")},
+		DryRun:                  true,
+		Recheck:                 time.Millisecond,
+	}
+	orphaned := []string{"z...rsp-app-node01-0a1b2c3d", "z...rsp-app-node02-22222222"}
+	topics, err := c.Cleanup(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, orphaned, topics)
+	assert.Len(t, deleted, 0)
+	assert.Equal(t, 2, observations)
+
+	c.DryRun = false
+	topics, err = c.Cleanup(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, orphaned, topics)
+	// deleted on nsqd, lookupd returns 404
+	assert.Equal(t, orphaned, deleted)
+}
+
+func TestReplyTopicCleanerCanceled(t *testing.T) {
+	nsqd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"topics":[{"topic_name":"z...rsp-app-node01-0a1b2c3d","channels":[]}]}`)
+	}))
+	defer nsqd.Close()
+	c := &ReplyTopicCleaner{
+		NSQDHTTPAddresses: []string{strings.TrimPrefix(nsqd.URL, "http://")},
+		Recheck:           time.Minute,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	topics, err := c.Cleanup(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Len(t, topics, 0)
+}
+
+func TestReplyTopicCleanerDefaultRecheck(t *testing.T) {
+	// consumer attaches to the topic on new nsqd after one lookupd poll
+	attached := false
+	nsqd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attached {
+			fmt.Fprint(w, `{"topics":[{"topic_name":"z...rsp-app-node01-0a1b2c3d","channels":[{"clients":[{"hostname":"node01"}]}]}]}`)
+			return
+		}
+		fmt.Fprint(w, `{"topics":[{"topic_name":"z...rsp-app-node01-0a1b2c3d","channels":[]}]}`)
+	}))
+	defer nsqd.Close()
+	var waited time.Duration
+	c := &ReplyTopicCleaner{
+		NSQDHTTPAddresses: []string{strings.TrimPrefix(nsqd.URL, "http://")},
+		DryRun:            true,
+		after: func(d time.Duration) <-chan time.Time {
+			waited = d
+			if d > time.Minute {
+				attached = true
+			}
+			ch := make(chan time.Time, 1)
+			ch <- time.Now()
+			return ch
+		},
+	}
+	topics, err := c.Cleanup(context.Background())
+	assert.Nil(t, err)
+	assert.Len(t, topics, 0)
+	assert.Equal(t, DefaultCleanupRecheck, waited)
+	assert.True(t, waited >= 2*nsq.NewConfig().LookupdPollInterval)
+}
@@ -0,0 +1,49 @@
+// Command rsp_cleanup deletes orphaned rpc reply topics (z...rsp-*) from nsq
+// cluster. Topic is orphaned when none of its channels has connected client
+// in two observations recheck apart.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/minus5/nsqm"
+)
+
+type addrs []string
+
+func (a *addrs) String() string     { return strings.Join(*a, ",") }
+func (a *addrs) Set(s string) error { *a = append(*a, s); return nil }
+
+func main() {
+	var c nsqm.ReplyTopicCleaner
+	var timeout time.Duration
+	flag.Var((*addrs)(&c.NSQLookupdHTTPAddresses), "lookupd-http-address", "nsqlookupd http address (may be given multiple times)")
+	flag.Var((*addrs)(&c.NSQDHTTPAddresses), "nsqd-http-address", "nsqd http address (may be given multiple times)")
+	flag.BoolVar(&c.DryRun, "dry-run", false, "only list orphaned topics")
+	flag.DurationVar(&c.Recheck, "recheck", nsqm.DefaultCleanupRecheck, "interval between two observations of orphaned topic")
+	flag.DurationVar(&timeout, "timeout", 10*time.Second, "http request timeout")
+	flag.Parse()
+	if len(c.NSQLookupdHTTPAddresses) == 0 && len(c.NSQDHTTPAddresses) == 0 {
+		c.NSQLookupdHTTPAddresses = []string{"127.0.0.1:4161"}
+	}
+	c.HTTPClient = &http.Client{Timeout: timeout}
+
+	topics, err := c.Cleanup(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, t := range topics {
+		fmt.Println(t)
+	}
+	if c.DryRun {
+		log.Printf("found %d orphaned reply topics", len(topics))
+		return
+	}
+	log.Printf("deleted %d orphaned reply topics", len(topics))
+}
@@ -5,6 +5,8 @@ import (
 	"time"
 
 	"github.com/minus5/nsqm/discovery"
+	"github.com/minus5/nsqm/log"
+	"github.com/minus5/nsqm/rpc"
 	nsq "github.com/nsqio/go-nsq"
 )
 
@@ -15,9 +17,51 @@ type Config struct {
 	NSQLookupdAddresses []string
 	Concurrency         int
 	NodeName            string
-	Logger              logger
-	LogLevel            nsq.LogLevel
-	dcy                 discoverer
+	// Logger for nsq producers and consumers, rpc clients and servers.
+	// See log.FromOutput and log.Slog for adapters.
+	Logger log.Logger
+	// LogLevel minimal level of go-nsq log lines.
+	LogLevel nsq.LogLevel
+	// Transport used by rpc clients and servers instead of nsqd, optional.
+	// See memory.NewBroker for in process transport.
+	Transport Transport
+	// EnvelopeFormat used by rpc clients for sending requests.
+	// Servers accept all formats and reply in the format of the request.
+	EnvelopeFormat rpc.Format
+	// EphemeralReplies rpc clients use ephemeral reply topic and channel,
+	// deleted by nsqd when client disconnects. Replies are not persisted to
+	// disk. Without it reply topics of stopped clients stay in nsqd, see
+	// ReplyTopicCleaner.
+	EphemeralReplies bool
+	// BroadcastRequests rpc servers also receive requests sent with
+	// RpcClient Broadcast and Gather, each server instance on its own
+	// ephemeral channel.
+	BroadcastRequests bool
+	// Tracer for rpc clients and servers, optional.
+	// See rpc/otel for OpenTelemetry tracer.
+	Tracer rpc.Tracer
+	// Metrics collector for rpc clients and servers, optional.
+	// See rpc/prometheus for Prometheus collector.
+	Metrics rpc.Metrics
+	// ClientInterceptors added to each rpc client, called in order.
+	ClientInterceptors []rpc.ClientInterceptor
+	// RetryPolicy for rpc clients, nil disables retries.
+	RetryPolicy *rpc.RetryPolicy
+	// Batching of concurrent rpc client requests into MultiPublish, nil
+	// publishes each request separately.
+	Batching *rpc.Batching
+	// AsyncPublishWindow rpc clients and servers publish with nsq
+	// PublishAsync, with at most window publishes waiting for nsqd
+	// acknowledge. Zero publishes synchronously.
+	AsyncPublishWindow int
+	// ServerInterceptors added to each rpc server, called in order.
+	ServerInterceptors []rpc.ServerInterceptor
+	// DedupStore enables deduplication of requests in rpc servers.
+	// See rpc.NewMemoryDedupStore.
+	DedupStore rpc.DedupStore
+	// PanicPolicy what rpc server does with the message when application panics.
+	PanicPolicy rpc.PanicPolicy
+	dcy         discoverer
 }
 
 type discoverer interface {
@@ -27,14 +71,6 @@ type discoverer interface {
 	NodeName() string
 }
 
-type logger interface {
-	Output(calldepth int, s string) error
-}
-
-type nullLogger struct{}
-
-func (nullLogger) Output(calldepth int, s string) error { return nil }
-
 // Subscribe to nsqlookupd changes.
 // Wehn location of nsqlookupd changes discovery will notify subscriber.
 func (c *Config) Subscribe(subscriber discovery.Subscriber) {
@@ -43,6 +79,13 @@ func (c *Config) Subscribe(subscriber discovery.Subscriber) {
 	}
 }
 
+func (c *Config) logger() log.Logger {
+	if c.Logger == nil {
+		return log.Nop
+	}
+	return c.Logger
+}
+
 func (c *Config) nsqConfig() *nsq.Config {
 	if c.NSQConfig == nil {
 		c.NSQConfig = nsq.NewConfig()
@@ -68,12 +111,22 @@ func Local() *Config {
 		NSQConfig:           c,
 		Concurrency:         Concurrency,
 		NodeName:            hostname,
-		Logger:              &nullLogger{},
+		Logger:              log.Nop,
 	}
 }
 
+// loggerer is implemented by discoveries which have logger.
+type loggerer interface {
+	Logger() log.Logger
+}
+
 // WithDiscovery creates Config populated from discovery.x
+// Config.Logger is set to the discovery logger (consul.WithLogger).
 func WithDiscovery(dcy discoverer) (*Config, error) {
+	logger := log.Nop
+	if l, ok := dcy.(loggerer); ok {
+		logger = l.Logger()
+	}
 	nsqd, err := dcy.NSQDAddress()
 	if err != nil {
 		return nil, err
@@ -91,7 +144,7 @@ func WithDiscovery(dcy discoverer) (*Config, error) {
 		NSQConfig:           c,
 		Concurrency:         Concurrency,
 		NodeName:            dcy.NodeName(),
-		Logger:              &nullLogger{},
+		Logger:              logger,
 		dcy:                 dcy,
 	}, nil
 }
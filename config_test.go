@@ -0,0 +1,36 @@
+package nsqm
+
+import (
+	"testing"
+
+	"github.com/minus5/nsqm/discovery"
+	"github.com/minus5/nsqm/log"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeDiscovery struct {
+	logger log.Logger
+}
+
+func (d *fakeDiscovery) NSQDAddress() (string, error) { return "10.0.0.1:4150", nil }
+func (d *fakeDiscovery) NSQLookupdAddresses() ([]string, error) {
+	return []string{"10.0.0.1:4161"}, nil
+}
+func (d *fakeDiscovery) Subscribe(discovery.Subscriber) {}
+func (d *fakeDiscovery) NodeName() string               { return "node01" }
+func (d *fakeDiscovery) Logger() log.Logger             { return d.logger }
+
+type logLines []string
+
+func (l *logLines) Log(level log.Level, msg string, fields ...interface{}) {
+	*l = append(*l, msg)
+}
+
+func TestWithDiscoveryLogger(t *testing.T) {
+	var lines logLines
+	cfg, err := WithDiscovery(&fakeDiscovery{logger: &lines})
+	assert.Nil(t, err)
+	assert.Equal(t, "node01", cfg.NodeName)
+	cfg.logger().Log(log.LevelInfo, "started")
+	assert.Equal(t, logLines{"started"}, lines)
+}
@@ -8,6 +8,7 @@ import (
 
 	"github.com/hashicorp/consul/api"
 	"github.com/minus5/nsqm/discovery"
+	"github.com/minus5/nsqm/log"
 )
 
 const (
@@ -19,31 +20,76 @@ const (
 	nsqdTCPServiceTag              = "tcp"
 )
 
+// Option configures discovery created by New.
+type Option func(*dcy)
+
+// WithLogger sets logger for reporting consul query failures and nsqlookupd
+// changes. nsqm.WithDiscovery uses the same logger for Config.Logger.
+func WithLogger(l log.Logger) Option {
+	return func(d *dcy) {
+		d.SetLogger(l)
+	}
+}
+
 // Local creates discovery with local consul addres.
-func Local() (*dcy, error) {
-	return New("127.0.0.1:8500")
+func Local(opts ...Option) (*dcy, error) {
+	return New("127.0.0.1:8500", opts...)
 }
 
 // New creates discovery using provided consul address.
-func New(addr string) (*dcy, error) {
+func New(addr string, opts ...Option) (*dcy, error) {
 	cfg := api.DefaultConfig()
 	cfg.Address = addr
 	cli, err := api.NewClient(cfg)
 	if err != nil {
 		return nil, err
 	}
-	return &dcy{cli: cli, addr: addr}, nil
+	d := &dcy{cli: cli, addr: addr, logger: log.Nop}
+	for _, o := range opts {
+		o(d)
+	}
+	return d, nil
 }
 
 type dcy struct {
 	addr         string
 	cli          *api.Client
+	logger       log.Logger
 	lookupdAddrs []string
 	subscribers  []discovery.Subscriber
+	err          error
 	sync.Mutex
 	monitorOnce sync.Once
 }
 
+// SetLogger sets logger for reporting consul query failures and nsqlookupd
+// changes.
+func (d *dcy) SetLogger(l log.Logger) {
+	if l == nil {
+		l = log.Nop
+	}
+	d.logger = l
+}
+
+// Logger returns logger set by WithLogger or SetLogger.
+func (d *dcy) Logger() log.Logger {
+	return d.logger
+}
+
+// Err returns error of the last failed consul query, nil when the last
+// query succeeded.
+func (d *dcy) Err() error {
+	d.Lock()
+	defer d.Unlock()
+	return d.err
+}
+
+func (d *dcy) setErr(err error) {
+	d.Lock()
+	defer d.Unlock()
+	d.err = err
+}
+
 type service struct {
 	name string
 	tag  string
@@ -153,18 +199,21 @@ func (d *dcy) monitor() {
 		}
 		ses, qm, err := d.cli.Health().Service(nsqLookupdHTTPServiceName, "", true, qo)
 		if err != nil {
-			//log.Printf("error: %s", err) // TODO
+			d.logger.Log(log.LevelError, "consul service query failed", "service", nsqLookupdHTTPServiceName, "error", err)
+			d.setErr(err)
 			time.Sleep(time.Second)
 			continue
 		}
 		if len(ses) == 0 {
 			ses, qm, err = d.cli.Health().Service(nsqLookupdHTTPServiceNameByTag, nsqLookupdHTTPServiceTag, true, qo)
 			if err != nil {
-				//log.Printf("error: %s", err) // TODO
+				d.logger.Log(log.LevelError, "consul service query failed", "service", nsqLookupdHTTPServiceNameByTag, "tag", nsqLookupdHTTPServiceTag, "error", err)
+				d.setErr(err)
 				time.Sleep(time.Second)
 				continue
 			}
 		}
+		d.setErr(nil)
 		addrs := parseServiceEntries(ses)
 		d.updateLookups(addrs)
 		wi = qm.LastIndex
@@ -197,10 +246,9 @@ func (d *dcy) updateLookups(addrs []string) {
 			// add newly discovered lookupd
 			if !contains(d.lookupdAddrs, addr) {
 				changed = true
-				//fmt.Println("ConnectToNSQLookupd", addr) // TODO
+				d.logger.Log(log.LevelInfo, "connecting to nsqlookupd", "addr", addr)
 				if err := subscriber.ConnectToNSQLookupd(addr); err != nil {
-					// TODO logging
-					//log.Printf("error: %s", err) // TODO
+					d.logger.Log(log.LevelError, "nsqlookupd connect failed", "addr", addr, "error", err)
 				}
 			}
 		}
@@ -208,16 +256,15 @@ func (d *dcy) updateLookups(addrs []string) {
 			// remove lookupd which don't exists any more
 			if !contains(addrs, addr) {
 				changed = true
-				//fmt.Println("DisconnectFromNSQLookupd", addr) // TODO
+				d.logger.Log(log.LevelInfo, "disconnecting from nsqlookupd", "addr", addr)
 				if err := subscriber.DisconnectFromNSQLookupd(addr); err != nil {
-					// TODO logging
-					//log.Printf("error: %s", err) // TODO
+					d.logger.Log(log.LevelError, "nsqlookupd disconnect failed", "addr", addr, "error", err)
 				}
 			}
 		}
 	}
 	if changed {
-		//fmt.Printf("updating lookupds to %v\n", addrs)
+		d.logger.Log(log.LevelInfo, "nsqlookupd addresses updated", "addrs", addrs)
 		d.lookupdAddrs = addrs
 	}
 }
@@ -228,6 +275,7 @@ func (d *dcy) updateLookups(addrs []string) {
 func (d *dcy) NodeName() string {
 	s, err := d.cli.Agent().Self()
 	if err != nil {
+		d.logger.Log(log.LevelError, "consul agent query failed", "error", err)
 		return ""
 	}
 	cfg := s["Config"]
@@ -12,20 +12,22 @@ import (
 	"github.com/minus5/nsqm/example/rpc_with_code_generator/service"
 	"github.com/minus5/nsqm/example/rpc_with_code_generator/service/api"
 	"github.com/minus5/nsqm/example/rpc_with_code_generator/service/api/nsq"
+	nsqmlog "github.com/minus5/nsqm/log"
 )
 
 func consulConfig() *nsqm.Config {
 	logFlags := log.LstdFlags | log.Lmicroseconds | log.Lshortfile
 	log.SetFlags(logFlags)
-	dcy, err := consul.Local()
+	logger := nsqmlog.FromOutput(log.New(os.Stderr, "", logFlags), nsqmlog.LevelInfo)
+	dcy, err := consul.Local(consul.WithLogger(logger))
 	if err != nil {
 		log.Fatal(err)
 	}
+	// cfg.Logger is the consul logger
 	cfg, err := nsqm.WithDiscovery(dcy)
 	if err != nil {
 		log.Fatal(err)
 	}
-	cfg.Logger = log.New(os.Stderr, "", logFlags)
 	cfg.LogLevel = 2
 	return cfg
 }
@@ -4,7 +4,7 @@ package api
 import (
 	"context"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"time"
 )
 
@@ -30,6 +30,12 @@ type callHook interface {
 	OnError(error)
 }
 
+// codedError is structured application error returned by transport
+type codedError interface {
+	error
+	ErrorCode() string
+}
+
 // noopHook no operation hook, using this where no hook is provided
 type noopHook struct{}
 
@@ -39,38 +45,238 @@ func (h *noopHook) OnRequest(method string, reqBuf []byte) error
 func (h *noopHook) OnTimeout(method string, appErr string) error                 { return nil }
 func (h *noopHook) OnError(err error)                                            {}
 
+// codecSetter is implemented by transports which send codec name with each request
+type codecSetter interface {
+	SetCodec(name string)
+}
+
+// sender is implemented by transports which send one-way requests
+type sender interface {
+	Send(ctx context.Context, method string, req []byte) error
+}
+
+// scheduler is implemented by transports which send deferred one-way requests
+type scheduler interface {
+	SendDeferred(ctx context.Context, method string, delay time.Duration, req []byte) error
+}
+
+// broadcaster is implemented by transports which send requests to all server instances
+type broadcaster interface {
+	Broadcast(ctx context.Context, method string, req []byte) error
+	Gather(ctx context.Context, method string, req []byte, reply func(rsp []byte, appErr string, err error)) error
+}
+
+// ErrNotSupported transport doesn't support call mode
+var ErrNotSupported = errors.New("not supported by transport")
+
 type Client struct {
 	t transport
 }
 
 func NewClient(t transport) *Client {
+	// tell transport which codec is used for request bodies
+	if cs, ok := t.(codecSetter); ok {
+		cs.SetCodec(CodecName)
+	}
 	return &Client{t: t}
 }
 
 func (c *Client) Add(ctx context.Context, req TwoReq, h callHook) (*OneRsp, error) {
 	rsp := new(OneRsp)
-	if err := c.call(ctx, MethodAdd, req, rsp, h); err != nil {
+	if err := c.call(ctx, MethodAdd, &req, rsp, h); err != nil {
 		return nil, err
 	}
 	return rsp, nil
 }
 
+// SendAdd sends one-way request, doesn't wait for reply.
+func (c *Client) SendAdd(ctx context.Context, req TwoReq) error {
+	return c.send(ctx, MethodAdd, &req, false)
+}
+
+// ScheduleAdd sends one-way request which is delivered to the server
+// after delay. Deadline of ctx is relative to the delivery time.
+func (c *Client) ScheduleAdd(ctx context.Context, delay time.Duration, req TwoReq) error {
+	s, ok := c.t.(scheduler)
+	if !ok {
+		return ErrNotSupported
+	}
+	reqBuf, err := Marshal(&req)
+	if err != nil {
+		return err
+	}
+	return s.SendDeferred(ctx, MethodAdd, delay, reqBuf)
+}
+
+// BroadcastAdd sends one-way request to all server instances.
+func (c *Client) BroadcastAdd(ctx context.Context, req TwoReq) error {
+	return c.send(ctx, MethodAdd, &req, true)
+}
+
+// GatherAdd sends request to all server instances and collects replies
+// until ctx is done (or timeout). Returns successful replies and errors of
+// the failed ones.
+func (c *Client) GatherAdd(ctx context.Context, req TwoReq) ([]*OneRsp, []error, error) {
+	var rsps []*OneRsp
+	errs, err := c.gather(ctx, MethodAdd, &req, func(buf []byte) error {
+		rsp := new(OneRsp)
+		if err := Unmarshal(buf, rsp); err != nil {
+			return err
+		}
+		rsps = append(rsps, rsp)
+		return nil
+	})
+	return rsps, errs, err
+}
+
 func (c *Client) Cube(ctx context.Context, req int, h callHook) (*int, error) {
 	rsp := new(int)
-	if err := c.call(ctx, MethodCube, req, rsp, h); err != nil {
+	if err := c.call(ctx, MethodCube, &req, rsp, h); err != nil {
 		return nil, err
 	}
 	return rsp, nil
 }
 
+// SendCube sends one-way request, doesn't wait for reply.
+func (c *Client) SendCube(ctx context.Context, req int) error {
+	return c.send(ctx, MethodCube, &req, false)
+}
+
+// ScheduleCube sends one-way request which is delivered to the server
+// after delay. Deadline of ctx is relative to the delivery time.
+func (c *Client) ScheduleCube(ctx context.Context, delay time.Duration, req int) error {
+	s, ok := c.t.(scheduler)
+	if !ok {
+		return ErrNotSupported
+	}
+	reqBuf, err := Marshal(&req)
+	if err != nil {
+		return err
+	}
+	return s.SendDeferred(ctx, MethodCube, delay, reqBuf)
+}
+
+// BroadcastCube sends one-way request to all server instances.
+func (c *Client) BroadcastCube(ctx context.Context, req int) error {
+	return c.send(ctx, MethodCube, &req, true)
+}
+
+// GatherCube sends request to all server instances and collects replies
+// until ctx is done (or timeout). Returns successful replies and errors of
+// the failed ones.
+func (c *Client) GatherCube(ctx context.Context, req int) ([]*int, []error, error) {
+	var rsps []*int
+	errs, err := c.gather(ctx, MethodCube, &req, func(buf []byte) error {
+		rsp := new(int)
+		if err := Unmarshal(buf, rsp); err != nil {
+			return err
+		}
+		rsps = append(rsps, rsp)
+		return nil
+	})
+	return rsps, errs, err
+}
+
 func (c *Client) Multiply(ctx context.Context, req TwoReq, h callHook) (*OneRsp, error) {
 	rsp := new(OneRsp)
-	if err := c.call(ctx, MethodMultiply, req, rsp, h); err != nil {
+	if err := c.call(ctx, MethodMultiply, &req, rsp, h); err != nil {
 		return nil, err
 	}
 	return rsp, nil
 }
 
+// SendMultiply sends one-way request, doesn't wait for reply.
+func (c *Client) SendMultiply(ctx context.Context, req TwoReq) error {
+	return c.send(ctx, MethodMultiply, &req, false)
+}
+
+// ScheduleMultiply sends one-way request which is delivered to the server
+// after delay. Deadline of ctx is relative to the delivery time.
+func (c *Client) ScheduleMultiply(ctx context.Context, delay time.Duration, req TwoReq) error {
+	s, ok := c.t.(scheduler)
+	if !ok {
+		return ErrNotSupported
+	}
+	reqBuf, err := Marshal(&req)
+	if err != nil {
+		return err
+	}
+	return s.SendDeferred(ctx, MethodMultiply, delay, reqBuf)
+}
+
+// BroadcastMultiply sends one-way request to all server instances.
+func (c *Client) BroadcastMultiply(ctx context.Context, req TwoReq) error {
+	return c.send(ctx, MethodMultiply, &req, true)
+}
+
+// GatherMultiply sends request to all server instances and collects replies
+// until ctx is done (or timeout). Returns successful replies and errors of
+// the failed ones.
+func (c *Client) GatherMultiply(ctx context.Context, req TwoReq) ([]*OneRsp, []error, error) {
+	var rsps []*OneRsp
+	errs, err := c.gather(ctx, MethodMultiply, &req, func(buf []byte) error {
+		rsp := new(OneRsp)
+		if err := Unmarshal(buf, rsp); err != nil {
+			return err
+		}
+		rsps = append(rsps, rsp)
+		return nil
+	})
+	return rsps, errs, err
+}
+
+func (c *Client) send(ctx context.Context, method string, req interface{}, broadcast bool) error {
+	reqBuf, err := Marshal(req)
+	if err != nil {
+		return err
+	}
+	if broadcast {
+		b, ok := c.t.(broadcaster)
+		if !ok {
+			return ErrNotSupported
+		}
+		return b.Broadcast(ctx, method, reqBuf)
+	}
+	s, ok := c.t.(sender)
+	if !ok {
+		return ErrNotSupported
+	}
+	return s.Send(ctx, method, reqBuf)
+}
+
+func (c *Client) gather(ctx context.Context, method string, req interface{}, unmarshal func([]byte) error) ([]error, error) {
+	b, ok := c.t.(broadcaster)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	reqBuf, err := Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	var errs []error
+	err = b.Gather(ctx, method, reqBuf, func(rspBuf []byte, appErr string, err error) {
+		var ce codedError
+		switch {
+		case errors.As(err, &ce):
+			errs = append(errs, toCodedError(ce))
+		case err != nil:
+			errs = append(errs, err)
+		case appErr != "":
+			errs = append(errs, toAppError(appErr))
+		default:
+			if err := unmarshal(rspBuf); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	})
+	return errs, err
+}
+
 func (c *Client) call(ctx context.Context, method string, req, rsp interface{}, h callHook) error {
 	if h == nil {
 		h = &noopHook{}
@@ -91,7 +297,8 @@ func (c *Client) call(ctx context.Context, method string, req, rsp interface{},
 		h.OnError(hErr)
 		return context.Canceled
 	}
-	ctxT, _ := context.WithTimeout(ctx, timeout)
+	ctxT, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
 	rspBuf, appErr, err := c.t.Call(ctxT, method, reqBuf)
 	if err := ctxT.Err(); err != nil {
 		h.OnError(err)
@@ -103,7 +310,8 @@ func (c *Client) call(ctx context.Context, method string, req, rsp interface{},
 		}
 		return err // context.DeadlineExceeded || context.Canceled
 	}
-	if err != nil {
+	var ce codedError
+	if err != nil && !errors.As(err, &ce) {
 		h.OnError(err)
 		return context.Canceled
 	}
@@ -112,6 +320,9 @@ func (c *Client) call(ctx context.Context, method string, req, rsp interface{},
 		h.OnError(hErr)
 		return context.Canceled
 	}
+	if ce != nil {
+		return toCodedError(ce)
+	}
 	return c.unmarshalRsp(rspBuf, appErr, rsp, h)
 }
 
@@ -142,9 +353,23 @@ func toAppError(txt string) error {
 	case Overflow.Error():
 		return Overflow
 	}
-	return fmt.Errorf(txt)
+	return errors.New(txt)
 }
 
+// toCodedError maps structured application error to the error declared in
+// api package with the same name as error code.
+// Unknown codes are returned as is, use errors.As to inspect them.
+func toCodedError(err codedError) error {
+	switch err.ErrorCode() {
+	case "Overflow":
+		return Overflow
+	}
+	return err
+}
+
+// CodecName name of the codec used for request and response bodies
+const CodecName = "json"
+
 func Marshal(v interface{}) ([]byte, error) {
 	return json.Marshal(v)
 }
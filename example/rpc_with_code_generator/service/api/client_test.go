@@ -0,0 +1,46 @@
+package api
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// callTransport supports only Call.
+type callTransport struct{}
+
+func (callTransport) Call(ctx context.Context, method string, req []byte) ([]byte, string, error) {
+	return nil, "", nil
+}
+
+func (callTransport) Close() error { return nil }
+
+// schedulerTransport records deferred requests.
+type schedulerTransport struct {
+	callTransport
+	method string
+	delay  time.Duration
+	req    []byte
+}
+
+func (t *schedulerTransport) SendDeferred(ctx context.Context, method string, delay time.Duration, req []byte) error {
+	t.method, t.delay, t.req = method, delay, req
+	return nil
+}
+
+func TestSchedule(t *testing.T) {
+	tr := &schedulerTransport{}
+	c := NewClient(tr)
+	assert.Nil(t, c.ScheduleAdd(context.Background(), time.Minute, TwoReq{X: 1, Y: 2}))
+	assert.Equal(t, MethodAdd, tr.method)
+	assert.Equal(t, time.Minute, tr.delay)
+	var req TwoReq
+	assert.Nil(t, Unmarshal(tr.req, &req))
+	assert.Equal(t, TwoReq{X: 1, Y: 2}, req)
+
+	// transport without deferred requests
+	c = NewClient(callTransport{})
+	assert.Equal(t, ErrNotSupported, c.ScheduleAdd(context.Background(), time.Minute, TwoReq{}))
+}
@@ -3,11 +3,18 @@ package service
 
 import (
 	"context"
+	"errors"
 	"fmt"
 
 	"github.com/minus5/nsqm/example/rpc_with_code_generator/service/api"
+	"github.com/minus5/nsqm/rpc"
 )
 
+// Codec returns name of the codec expected in request bodies.
+func (s *Service) Codec() string {
+	return api.CodecName
+}
+
 func (s *Service) Serve(ctx context.Context, method string, buf []byte) ([]byte, error) {
 	switch method {
 	case api.MethodAdd:
@@ -17,7 +24,7 @@ func (s *Service) Serve(ctx context.Context, method string, buf []byte) ([]byte,
 		}
 		rsp, err := s.Add(ctx, req)
 		if err != nil {
-			return nil, err
+			return nil, appError(err)
 		}
 		return api.Marshal(rsp)
 	case api.MethodCube:
@@ -27,7 +34,7 @@ func (s *Service) Serve(ctx context.Context, method string, buf []byte) ([]byte,
 		}
 		rsp, err := s.Cube(ctx, req)
 		if err != nil {
-			return nil, err
+			return nil, appError(err)
 		}
 		return api.Marshal(rsp)
 	case api.MethodMultiply:
@@ -37,10 +44,19 @@ func (s *Service) Serve(ctx context.Context, method string, buf []byte) ([]byte,
 		}
 		rsp, err := s.Multiply(ctx, req)
 		if err != nil {
-			return nil, err
+			return nil, appError(err)
 		}
 		return api.Marshal(rsp)
 	default:
 		return nil, fmt.Errorf("unknown method %s", method)
 	}
 }
+
+// appError converts errors declared in api package into structured errors
+// with error name as code, so client can match them by code.
+func appError(err error) error {
+	if errors.Is(err, api.Overflow) {
+		return &rpc.Error{Code: "Overflow", Message: err.Error()}
+	}
+	return err
+}
@@ -2,11 +2,18 @@ package nsqm
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"os"
 	"path"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/minus5/nsqm/log"
 	"github.com/minus5/nsqm/rpc"
 	nsq "github.com/nsqio/go-nsq"
 )
@@ -17,7 +24,7 @@ func NewProducer(cfg *Config) (*nsq.Producer, error) {
 	if err != nil {
 		return nil, err
 	}
-	producer.SetLogger(cfg.Logger, cfg.LogLevel)
+	producer.SetLogger(log.NSQ(cfg.logger()), cfg.LogLevel)
 	return producer, nil
 }
 
@@ -27,7 +34,7 @@ func NewConsumer(cfg *Config, topic, channel string, handler nsq.Handler) (*nsq.
 	if err != nil {
 		return nil, err
 	}
-	consumer.SetLogger(cfg.Logger, cfg.LogLevel)
+	consumer.SetLogger(log.NSQ(cfg.logger()), cfg.LogLevel)
 	consumer.AddConcurrentHandlers(handler, cfg.Concurrency)
 	if addrs := cfg.NSQLookupdAddresses; addrs != nil {
 		if err := consumer.ConnectToNSQLookupds(addrs); err != nil {
@@ -42,100 +49,405 @@ func NewConsumer(cfg *Config, topic, channel string, handler nsq.Handler) (*nsq.
 	return consumer, nil
 }
 
+// NewRpcClient creates rpc client which sends requests to reqTopic.
+// Clients created with the same cfg share one nsq producer, reply topic and
+// consumer; clients with different Configs are independent. Shared
+// connections are stopped when the last client using them is closed.
 func NewRpcClient(cfg *Config, reqTopic string) (*RpcClient, error) {
 	factoryMutex.Lock()
 	defer factoryMutex.Unlock()
-	// ensuring that there is only one client handler per application
-	if rpcHandler != nil {
-		return &RpcClient{
-			reqTopic: reqTopic,
-			handler:  rpcHandler}, nil
+	t, ok := rpcTransports[cfg]
+	if !ok {
+		var err error
+		if t, err = newRpcTransport(cfg); err != nil {
+			return nil, err
+		}
+		rpcTransports[cfg] = t
 	}
+	t.refs++
+	return &RpcClient{
+		reqTopic:  reqTopic,
+		transport: t,
+		handler:   t.handler,
+	}, nil
+}
 
+// rpcTransport nsq connections and rpc.Client shared by all RpcClients
+// created with the same Config.
+type rpcTransport struct {
+	cfg      *Config
+	producer Producer
+	consumer Consumer
+	handler  *rpc.Client
+	refs     int
+}
+
+func newRpcTransport(cfg *Config) (*rpcTransport, error) {
 	channel := appName()
-	rspTopic := fmt.Sprintf("z...rsp-%s-%s", appName(), cfg.NodeName)
-	producer, err := NewProducer(cfg)
+	rspTopic := rspTopicName(appName(), cfg.NodeName, newInstanceID(), cfg.EphemeralReplies)
+	if cfg.EphemeralReplies {
+		channel = ephemeral(channel)
+	}
+	producer, err := newProducer(cfg)
 	if err != nil {
 		return nil, err
 	}
-	rpcHandler = rpc.NewClient(producer, "", rspTopic)
-	consumer, err := NewConsumer(cfg, rspTopic, channel, rpcHandler)
+	handler := rpc.NewClient(producer, "", rspTopic)
+	handler.SetFormat(cfg.EnvelopeFormat)
+	handler.SetTracer(cfg.Tracer)
+	handler.SetMetrics(cfg.Metrics)
+	handler.SetLogger(cfg.logger())
+	handler.SetRetryPolicy(cfg.RetryPolicy)
+	handler.SetBatching(cfg.Batching)
+	handler.SetAsyncPublish(cfg.AsyncPublishWindow)
+	handler.Use(cfg.ClientInterceptors...)
+	consumer, err := newConsumer(cfg, rspTopic, channel, handler)
 	if err != nil {
+		producer.Stop()
 		return nil, err
 	}
-	return &RpcClient{
-		reqTopic: reqTopic,
+	return &rpcTransport{
+		cfg:      cfg,
 		producer: producer,
 		consumer: consumer,
-		handler:  rpcHandler}, nil
+		handler:  handler,
+	}, nil
+}
+
+// stop stops receiving replies and then the producer.
+func (t *rpcTransport) stop() {
+	t.consumer.Stop()
+	<-t.consumer.Done()
+	t.producer.Stop()
 }
 
+// ErrClientClosed returned from Call on closed RpcClient.
+var ErrClientClosed = errors.New("rpc client closed")
+
 type RpcClient struct {
-	reqTopic string
-	producer *nsq.Producer
-	consumer *nsq.Consumer
-	handler  *rpc.Client
+	reqTopic  string
+	codec     string
+	transport *rpcTransport
+	handler   *rpc.Client
+	closed    int32
+}
+
+// SetCodec sets name of the codec used for request bodies.
+// It is sent with each request so server can reject mismatched bodies.
+func (c *RpcClient) SetCodec(name string) {
+	c.codec = name
 }
 
 func (c *RpcClient) Call(ctx context.Context, typ string, req []byte) ([]byte, string, error) {
-	return c.handler.CallTopic(ctx, c.reqTopic, typ, req)
+	if c.isClosed() {
+		return nil, "", ErrClientClosed
+	}
+	return c.handler.CallTopic(rpc.WithCodec(ctx, c.codec), c.reqTopic, typ, req)
+}
+
+// CallDeferred sends request which is delivered to the server after delay
+// and waits for the reply. See rpc.Client.CallDeferredTopic.
+func (c *RpcClient) CallDeferred(ctx context.Context, typ string, delay time.Duration, req []byte) ([]byte, string, error) {
+	if c.isClosed() {
+		return nil, "", ErrClientClosed
+	}
+	return c.handler.CallDeferredTopic(rpc.WithCodec(ctx, c.codec), c.reqTopic, typ, delay, req)
+}
+
+// CallBatch sends all requests in one nsq MultiPublish and waits for
+// replies. See rpc.Client.CallBatch.
+func (c *RpcClient) CallBatch(ctx context.Context, calls []rpc.BatchCall) []rpc.BatchReply {
+	if c.isClosed() {
+		replies := make([]rpc.BatchReply, len(calls))
+		for i := range replies {
+			replies[i].Err = ErrClientClosed
+		}
+		return replies
+	}
+	return c.handler.CallBatch(rpc.WithCodec(ctx, c.codec), c.reqTopic, calls)
 }
 
+// Send sends one-way request, server doesn't reply.
+func (c *RpcClient) Send(ctx context.Context, typ string, req []byte) error {
+	if c.isClosed() {
+		return ErrClientClosed
+	}
+	return c.handler.SendTopic(rpc.WithCodec(ctx, c.codec), c.reqTopic, typ, req)
+}
+
+// SendDeferred sends one-way request which is delivered to the server after
+// delay. See rpc.Client.SendDeferredTopic.
+func (c *RpcClient) SendDeferred(ctx context.Context, typ string, delay time.Duration, req []byte) error {
+	if c.isClosed() {
+		return ErrClientClosed
+	}
+	return c.handler.SendDeferredTopic(rpc.WithCodec(ctx, c.codec), c.reqTopic, typ, delay, req)
+}
+
+// Broadcast sends one-way request to all server instances started with
+// Config.BroadcastRequests.
+func (c *RpcClient) Broadcast(ctx context.Context, typ string, req []byte) error {
+	if c.isClosed() {
+		return ErrClientClosed
+	}
+	return c.handler.SendTopic(rpc.WithCodec(ctx, c.codec), broadcastTopicName(c.reqTopic), typ, req)
+}
+
+// Gather sends request to all server instances started with
+// Config.BroadcastRequests and calls reply for each reply received until ctx
+// is done, or rpc.DefaultGatherTimeout when ctx has no deadline.
+// Arguments of reply are same as return values of Call.
+func (c *RpcClient) Gather(ctx context.Context, typ string, req []byte, reply func(rsp []byte, appErr string, err error)) error {
+	if c.isClosed() {
+		return ErrClientClosed
+	}
+	rsps, err := c.handler.GatherTopic(rpc.WithCodec(ctx, c.codec), broadcastTopicName(c.reqTopic), typ, req)
+	if err != nil {
+		return err
+	}
+	for _, rsp := range rsps {
+		if rsp.AppError != nil {
+			reply(rsp.Body, rsp.Error, rsp.AppError)
+			continue
+		}
+		reply(rsp.Body, rsp.Error, nil)
+	}
+	return nil
+}
+
+// CallStream sends stream request, server application must implement
+// ServeStream. See rpc.Client.CallStream.
+func (c *RpcClient) CallStream(ctx context.Context, typ string, req []byte) (*rpc.Stream, error) {
+	if c.isClosed() {
+		return nil, ErrClientClosed
+	}
+	return c.handler.CallStream(rpc.WithCodec(ctx, c.codec), c.reqTopic, typ, req)
+}
+
+func (c *RpcClient) isClosed() bool {
+	return atomic.LoadInt32(&c.closed) == 1
+}
+
+// Close releases client. Nsq connections are stopped when the last client
+// created with the same Config is closed. Safe to call multiple times.
 func (c *RpcClient) Close() error {
-	if c.producer != nil {
-		c.producer.Stop()
+	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		return nil
+	}
+	factoryMutex.Lock()
+	t := c.transport
+	t.refs--
+	last := t.refs == 0
+	if last {
+		delete(rpcTransports, t.cfg)
 	}
-	if c.consumer != nil {
-		c.consumer.Stop()
+	factoryMutex.Unlock()
+	if last {
+		t.stop()
 	}
 	return nil
 }
 
-var rpcHandler *rpc.Client
-var factoryMutex sync.Mutex
+var (
+	rpcTransports = make(map[*Config]*rpcTransport)
+	factoryMutex  sync.Mutex
+)
+
+// newInstanceID creates random id of the rpc transport.
+// Part of the reply topic name so two processes (or two Configs in the same
+// process) with the same application name on the same node don't share reply
+// topic.
+func newInstanceID() string {
+	var buf [4]byte
+	rand.Read(buf[:])
+	return hex.EncodeToString(buf[:])
+}
 
 func appName() string {
 	return path.Base(os.Args[0])
 }
 
+// maxTopicLen maximal nsq topic or channel name length.
+const maxTopicLen = 64
+
+// ephemeralSuffix marks nsq topic or channel as ephemeral.
+// Ephemeral topic is deleted when its last channel is deleted, ephemeral
+// channel when its last client disconnects.
+const ephemeralSuffix = "#ephemeral"
+
+// rspTopicName creates topic name for replies: z...rsp-app-node-instance.
+// Application and node names are shortened to fit into nsq topic name limit,
+// instance is always kept whole.
+func rspTopicName(app, node, instance string, ephemeral bool) string {
+	app, node = topicSafe(app), topicSafe(node)
+	free := maxTopicLen - len(rspTopicPrefix) - len(instance) - 2
+	if ephemeral {
+		free -= len(ephemeralSuffix)
+	}
+	if len(app)+len(node) > free {
+		if len(node) > free/2 {
+			node = node[:free/2]
+		}
+		if len(app) > free-len(node) {
+			app = app[:free-len(node)]
+		}
+	}
+	name := fmt.Sprintf("%s%s-%s-%s", rspTopicPrefix, app, node, instance)
+	if ephemeral {
+		name += ephemeralSuffix
+	}
+	return name
+}
+
+// broadcastTopicName creates name of the ephemeral topic for requests which
+// are processed by all server instances: reqTopic.broadcast#ephemeral.
+func broadcastTopicName(reqTopic string) string {
+	const suffix = ".broadcast" + ephemeralSuffix
+	if len(reqTopic) > maxTopicLen-len(suffix) {
+		reqTopic = reqTopic[:maxTopicLen-len(suffix)]
+	}
+	return reqTopic + suffix
+}
+
+// ephemeral adds ephemeral suffix to the channel name.
+func ephemeral(channel string) string {
+	if len(channel) > maxTopicLen-len(ephemeralSuffix) {
+		channel = channel[:maxTopicLen-len(ephemeralSuffix)]
+	}
+	return channel + ephemeralSuffix
+}
+
+// topicSafe replaces characters not allowed in nsq topic names.
+func topicSafe(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '.' || r == '_' || r == '-' ||
+			(r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
 func NewRpcServer(cfg *Config, reqTopic string, srv AppServer) (*RpcServer, error) {
 	channel := appName()
-	producer, err := NewProducer(cfg)
+	producer, err := newProducer(cfg)
 	if err != nil {
 		return nil, err
 	}
 
 	ctx, ctxCancel := context.WithCancel(context.Background())
 	rpcServer := rpc.NewServer(ctx, srv, producer)
+	rpcServer.SetTracer(cfg.Tracer)
+	rpcServer.SetMetrics(cfg.Metrics)
+	rpcServer.Use(cfg.ServerInterceptors...)
+	rpcServer.SetLogger(cfg.logger())
+	rpcServer.SetPanicPolicy(cfg.PanicPolicy)
+	rpcServer.SetDedupStore(cfg.DedupStore)
+	rpcServer.SetAsyncPublish(cfg.AsyncPublishWindow)
 
-	consumer, err := NewConsumer(cfg, reqTopic, channel, rpcServer)
+	s := &RpcServer{
+		cfg:       cfg,
+		reqTopic:  reqTopic,
+		producer:  producer,
+		ctxCancel: ctxCancel,
+		server:    rpcServer,
+	}
+	consumer, err := newConsumer(cfg, reqTopic, channel, rpcServer)
 	if err != nil {
+		ctxCancel()
+		producer.Stop()
 		return nil, err
 	}
-
-	return &RpcServer{
-		producer:  producer,
-		ctxCancel: ctxCancel,
-		consumer:  consumer,
-	}, nil
+	s.consumers = append(s.consumers, consumer)
+	if cfg.BroadcastRequests {
+		// each server instance on its own channel
+		channel := ephemeral(topicSafe(appName()) + "-" + newInstanceID())
+		consumer, err := newConsumer(cfg, broadcastTopicName(reqTopic), channel, rpcServer)
+		if err != nil {
+			s.Stop()
+			s.Close()
+			return nil, err
+		}
+		s.consumers = append(s.consumers, consumer)
+	}
+	return s, nil
 }
 
 type AppServer interface {
 	Serve(ctx context.Context, typ string, req []byte) ([]byte, error)
 }
 
+// ErrServerStopped reported by Health of stopped RpcServer.
+var ErrServerStopped = errors.New("rpc server stopped")
+
 type RpcServer struct {
-	producer  *nsq.Producer
+	stopped   int32
+	cfg       *Config
+	reqTopic  string
+	producer  Producer
 	ctxCancel func()
-	consumer  *nsq.Consumer
+	consumers []Consumer
+	server    *rpc.Server
 }
 
 func (s *RpcServer) Stop() {
-	s.consumer.Stop() // stop receiving new requests
+	s.setStopped()
+	s.stopConsumers() // stop receiving new requests
 	s.ctxCancel()     // cancel all processing
-	<-s.consumer.StopChan
+	s.waitConsumers(context.Background())
+}
+
+func (s *RpcServer) stopConsumers() {
+	for _, c := range s.consumers {
+		c.Stop()
+	}
+}
+
+// waitConsumers waits for consumers to stop, until ctx is done.
+func (s *RpcServer) waitConsumers(ctx context.Context) error {
+	for _, c := range s.consumers {
+		select {
+		case <-c.Done():
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
 }
 
 func (s *RpcServer) Close() {
+	s.setStopped()
 	s.producer.Stop() // stop producing responses
 }
+
+func (s *RpcServer) setStopped() {
+	atomic.StoreInt32(&s.stopped, 1)
+}
+
+func (s *RpcServer) isStopped() bool {
+	return atomic.LoadInt32(&s.stopped) == 1
+}
+
+// Shutdown gracefully stops the server. Stops receiving new requests and
+// waits for in flight requests to complete and publish replies, and for
+// consumers to stop. When ctx is done before that, cancels processing so the
+// remaining requests are requeued, and waits for the application to return
+// from canceled requests. Closes producer at the end.
+// Returns counters of drained and requeued requests, and ctx error if
+// draining was not completed.
+func (s *RpcServer) Shutdown(ctx context.Context) (rpc.DrainStats, error) {
+	s.setStopped()
+	s.stopConsumers() // stop receiving new requests
+	err := s.server.Drain(ctx)
+	if err == nil {
+		err = s.waitConsumers(ctx)
+	}
+	if err != nil {
+		s.ctxCancel() // requeue the rest
+		s.server.Drain(context.Background())
+		s.waitConsumers(context.Background())
+	}
+	s.ctxCancel()
+	s.producer.Stop()
+	return s.server.DrainStats(), err
+}
@@ -0,0 +1,137 @@
+package nsqm
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	nsq "github.com/nsqio/go-nsq"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRspTopicName(t *testing.T) {
+	assert.Equal(t, "z...rsp-main-node01-0a1b2c3d", rspTopicName("main", "node01", "0a1b2c3d", false))
+	assert.Equal(t, "z...rsp-my_app-node01-0a1b2c3d", rspTopicName("my app", "node01", "0a1b2c3d", false))
+
+	long := strings.Repeat("a", 100)
+	n := rspTopicName(long, long, "0a1b2c3d", false)
+	assert.Len(t, n, maxTopicLen)
+	assert.True(t, strings.HasSuffix(n, "-0a1b2c3d"))
+
+	n = rspTopicName(long, "node01", "0a1b2c3d", false)
+	assert.Len(t, n, maxTopicLen)
+	assert.True(t, strings.HasSuffix(n, "-node01-0a1b2c3d"))
+
+	n = rspTopicName(long, long, "0a1b2c3d", true)
+	assert.Len(t, n, maxTopicLen)
+	assert.True(t, strings.HasSuffix(n, "-0a1b2c3d#ephemeral"))
+	assert.Equal(t, "main#ephemeral", ephemeral("main"))
+}
+
+func TestBroadcastTopicName(t *testing.T) {
+	assert.Equal(t, "service.req.broadcast#ephemeral", broadcastTopicName("service.req"))
+	assert.Len(t, broadcastTopicName(strings.Repeat("a", 100)), maxTopicLen)
+}
+
+func TestRpcClientsShareTransportPerConfig(t *testing.T) {
+	lookupd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"channels":[],"producers":[]}`)
+	}))
+	defer lookupd.Close()
+	newConfig := func() *Config {
+		cfg := Local()
+		cfg.NSQLookupdAddresses = []string{strings.TrimPrefix(lookupd.URL, "http://")}
+		return cfg
+	}
+	cfg1, cfg2 := newConfig(), newConfig()
+
+	c1, err := NewRpcClient(cfg1, "service1.req")
+	assert.Nil(t, err)
+	c2, err := NewRpcClient(cfg1, "service2.req")
+	assert.Nil(t, err)
+	c3, err := NewRpcClient(cfg2, "service1.req")
+	assert.Nil(t, err)
+	assert.True(t, c1.transport == c2.transport)
+	assert.False(t, c1.transport == c3.transport)
+	assert.Equal(t, 2, c1.transport.refs)
+
+	// closing one client doesn't affect the others
+	assert.Nil(t, c1.Close())
+	assert.Nil(t, c1.Close())
+	assert.Equal(t, 1, c2.transport.refs)
+	_, _, err = c1.Call(context.Background(), "Add", nil)
+	assert.Equal(t, ErrClientClosed, err)
+
+	assert.Nil(t, c2.Close())
+	assert.Nil(t, c3.Close())
+	assert.Len(t, rpcTransports, 0)
+}
+
+// slowTransport consumers stop after delay.
+type slowTransport struct {
+	delay time.Duration
+}
+
+type slowConsumer struct {
+	delay time.Duration
+	done  chan int
+}
+
+type nopProducer struct{}
+
+func (nopProducer) Publish(topic string, body []byte) error { return nil }
+func (nopProducer) Stop()                                   {}
+
+func (t slowTransport) NewProducer() (Producer, error) { return nopProducer{}, nil }
+
+func (t slowTransport) NewConsumer(topic, channel string, handler nsq.Handler, concurrency int) (Consumer, error) {
+	return &slowConsumer{delay: t.delay, done: make(chan int)}, nil
+}
+
+func (c *slowConsumer) Stop() {
+	time.AfterFunc(c.delay, func() { close(c.done) })
+}
+
+func (c *slowConsumer) Done() <-chan int { return c.done }
+
+type nopServer struct{}
+
+func (nopServer) Serve(ctx context.Context, typ string, req []byte) ([]byte, error) {
+	return nil, nil
+}
+
+func TestRpcServerShutdownDeadline(t *testing.T) {
+	cfg := Local()
+	cfg.Transport = slowTransport{delay: 100 * time.Millisecond}
+	srv, err := NewRpcServer(cfg, "service.req", nopServer{})
+	assert.Nil(t, err)
+
+	// consumers don't stop before ctx deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = srv.Shutdown(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestRpcServerHealthAfterStop(t *testing.T) {
+	cfg := Local()
+	cfg.Transport = slowTransport{}
+	for _, stop := range []func(*RpcServer){
+		(*RpcServer).Stop,
+		(*RpcServer).Close,
+		func(s *RpcServer) { s.Shutdown(context.Background()) },
+	} {
+		srv, err := NewRpcServer(cfg, "service.req", nopServer{})
+		assert.Nil(t, err)
+		assert.NotEqual(t, StatusDown, srv.Health().Status)
+		// producer without Ping stays up, server is down
+		stop(srv)
+		h := srv.Health()
+		assert.Equal(t, StatusDown, h.Status)
+		assert.Equal(t, ErrServerStopped.Error(), h.Error)
+	}
+}
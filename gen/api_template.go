@@ -7,9 +7,22 @@ package api
 
 import (
   "context"
+{{- if eq .Codec "json" }}
 	"encoding/json"
-  "fmt"
+{{- end }}
+	"errors"
+{{- if eq .Codec "protobuf" }}
+	"fmt"
+{{- end }}
   "time"
+{{- if eq .Codec "msgpack" }}
+
+	"github.com/vmihailenco/msgpack/v5"
+{{- end }}
+{{- if eq .Codec "protobuf" }}
+
+	"google.golang.org/protobuf/proto"
+{{- end }}
 )
 
 // method names constants
@@ -34,6 +47,12 @@ type callHook interface {
 	OnError(error)
 }
 
+// codedError is structured application error returned by transport
+type codedError interface {
+	error
+	ErrorCode() string
+}
+
 // noopHook no operation hook, using this where no hook is provided
 type noopHook struct{}
 
@@ -43,25 +62,145 @@ func (h *noopHook) OnRequest(method string, reqBuf []byte) error
 func (h *noopHook) OnTimeout(method string, appErr string) error                 { return nil }
 func (h *noopHook) OnError(err error)                                            {}
 
+// codecSetter is implemented by transports which send codec name with each request
+type codecSetter interface {
+	SetCodec(name string)
+}
+
+// sender is implemented by transports which send one-way requests
+type sender interface {
+	Send(ctx context.Context, method string, req []byte) error
+}
+
+// scheduler is implemented by transports which send deferred one-way requests
+type scheduler interface {
+	SendDeferred(ctx context.Context, method string, delay time.Duration, req []byte) error
+}
+
+// broadcaster is implemented by transports which send requests to all server instances
+type broadcaster interface {
+	Broadcast(ctx context.Context, method string, req []byte) error
+	Gather(ctx context.Context, method string, req []byte, reply func(rsp []byte, appErr string, err error)) error
+}
+
+// ErrNotSupported transport doesn't support call mode
+var ErrNotSupported = errors.New("not supported by transport")
+
 type Client struct {
   t transport
 }
 
 func NewClient(t transport) *Client {
+	// tell transport which codec is used for request bodies
+	if cs, ok := t.(codecSetter); ok {
+		cs.SetCodec(CodecName)
+	}
   return &Client{t: t}
 }
 
 {{- range .Methods }}
 
-func (c *Client) {{.Name}}(ctx context.Context, req {{ .In }}, h callHook) (*{{ .Out }}, error) {
+func (c *Client) {{.Name}}(ctx context.Context, req {{if .InPointer}}*{{end}}{{ .In }}, h callHook) (*{{ .Out }}, error) {
   rsp := new({{ .Out }})
-  if err := c.call(ctx, Method{{.Name}},req, rsp, h); err != nil {
+  if err := c.call(ctx, Method{{.Name}}, {{if not .InPointer}}&{{end}}req, rsp, h); err != nil {
     return nil, err
   }
   return rsp, nil
 }
+
+// Send{{.Name}} sends one-way request, doesn't wait for reply.
+func (c *Client) Send{{.Name}}(ctx context.Context, req {{if .InPointer}}*{{end}}{{ .In }}) error {
+  return c.send(ctx, Method{{.Name}}, {{if not .InPointer}}&{{end}}req, false)
+}
+
+// Schedule{{.Name}} sends one-way request which is delivered to the server
+// after delay. Deadline of ctx is relative to the delivery time.
+func (c *Client) Schedule{{.Name}}(ctx context.Context, delay time.Duration, req {{if .InPointer}}*{{end}}{{ .In }}) error {
+  s, ok := c.t.(scheduler)
+  if !ok {
+    return ErrNotSupported
+  }
+  reqBuf, err := Marshal({{if not .InPointer}}&{{end}}req)
+  if err != nil {
+    return err
+  }
+  return s.SendDeferred(ctx, Method{{.Name}}, delay, reqBuf)
+}
+
+// Broadcast{{.Name}} sends one-way request to all server instances.
+func (c *Client) Broadcast{{.Name}}(ctx context.Context, req {{if .InPointer}}*{{end}}{{ .In }}) error {
+  return c.send(ctx, Method{{.Name}}, {{if not .InPointer}}&{{end}}req, true)
+}
+
+// Gather{{.Name}} sends request to all server instances and collects replies
+// until ctx is done (or timeout). Returns successful replies and errors of
+// the failed ones.
+func (c *Client) Gather{{.Name}}(ctx context.Context, req {{if .InPointer}}*{{end}}{{ .In }}) ([]*{{ .Out }}, []error, error) {
+  var rsps []*{{ .Out }}
+  errs, err := c.gather(ctx, Method{{.Name}}, {{if not .InPointer}}&{{end}}req, func(buf []byte) error {
+    rsp := new({{ .Out }})
+    if err := Unmarshal(buf, rsp); err != nil {
+      return err
+    }
+    rsps = append(rsps, rsp)
+    return nil
+  })
+  return rsps, errs, err
+}
 {{- end }}
 
+func (c *Client) send(ctx context.Context, method string, req interface{}, broadcast bool) error {
+	reqBuf, err := Marshal(req)
+	if err != nil {
+		return err
+	}
+	if broadcast {
+		b, ok := c.t.(broadcaster)
+		if !ok {
+			return ErrNotSupported
+		}
+		return b.Broadcast(ctx, method, reqBuf)
+	}
+	s, ok := c.t.(sender)
+	if !ok {
+		return ErrNotSupported
+	}
+	return s.Send(ctx, method, reqBuf)
+}
+
+func (c *Client) gather(ctx context.Context, method string, req interface{}, unmarshal func([]byte) error) ([]error, error) {
+	b, ok := c.t.(broadcaster)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	reqBuf, err := Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	var errs []error
+	err = b.Gather(ctx, method, reqBuf, func(rspBuf []byte, appErr string, err error) {
+		var ce codedError
+		switch {
+		case errors.As(err, &ce):
+			errs = append(errs, toCodedError(ce))
+		case err != nil:
+			errs = append(errs, err)
+		case appErr != "":
+			errs = append(errs, toAppError(appErr))
+		default:
+			if err := unmarshal(rspBuf); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	})
+	return errs, err
+}
+
 func (c *Client) call(ctx context.Context, method string, req, rsp interface{}, h callHook) error {
 	if h == nil {
 		h = &noopHook{}
@@ -82,7 +221,8 @@ func (c *Client) call(ctx context.Context, method string, req, rsp interface{},
 		h.OnError(hErr)
 		return context.Canceled
 	}
-	ctxT, _ := context.WithTimeout(ctx, timeout)
+	ctxT, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
 	rspBuf, appErr, err := c.t.Call(ctxT, method, reqBuf)
 	if err := ctxT.Err(); err != nil {
 		h.OnError(err)
@@ -94,7 +234,8 @@ func (c *Client) call(ctx context.Context, method string, req, rsp interface{},
 		}
 		return err // context.DeadlineExceeded || context.Canceled
 	}
-	if err != nil {
+	var ce codedError
+	if err != nil && !errors.As(err, &ce) {
 		h.OnError(err)
 		return context.Canceled
 	}
@@ -103,6 +244,9 @@ func (c *Client) call(ctx context.Context, method string, req, rsp interface{},
 		h.OnError(hErr)
 		return context.Canceled
 	}
+	if ce != nil {
+		return toCodedError(ce)
+	}
 	return c.unmarshalRsp(rspBuf, appErr, rsp, h)
 }
 
@@ -136,8 +280,48 @@ func toAppError(txt string) error {
     return {{ . }}
 {{- end }}
   }
-	return fmt.Errorf(txt)
+	return errors.New(txt)
+}
+
+// toCodedError maps structured application error to the error declared in
+// api package with the same name as error code.
+// Unknown codes are returned as is, use errors.As to inspect them.
+func toCodedError(err codedError) error {
+	switch err.ErrorCode() {
+{{- range .Errors }}
+	case "{{ . }}":
+		return {{ . }}
+{{- end }}
+	}
+	return err
+}
+
+{{- if .CustomCodec }}
+
+// codec interface of the user supplied codec
+type codec interface {
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var _ codec = {{.CustomCodec}}
+
+// CodecName name of the codec used for request and response bodies
+var CodecName = {{.CustomCodec}}.Name()
+
+func Marshal(v interface{}) ([]byte, error) {
+	return {{.CustomCodec}}.Marshal(v)
+}
+
+func Unmarshal(data []byte, v interface{}) error {
+	return {{.CustomCodec}}.Unmarshal(data, v)
 }
+{{- else }}
+
+// CodecName name of the codec used for request and response bodies
+const CodecName = "{{.Codec}}"
+{{- if eq .Codec "json" }}
 
 func Marshal(v interface{}) ([]byte, error) {
 	return json.Marshal(v)
@@ -146,5 +330,34 @@ func Marshal(v interface{}) ([]byte, error) {
 func Unmarshal(data []byte, v interface{}) error {
 	return json.Unmarshal(data, v)
 }
+{{- end }}
+{{- if eq .Codec "msgpack" }}
+
+func Marshal(v interface{}) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+func Unmarshal(data []byte, v interface{}) error {
+	return msgpack.Unmarshal(data, v)
+}
+{{- end }}
+{{- if eq .Codec "protobuf" }}
+
+func Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("%T is not proto.Message", v)
+	}
+	return proto.Marshal(m)
+}
 
+func Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("%T is not proto.Message", v)
+	}
+	return proto.Unmarshal(data, m)
+}
+{{- end }}
+{{- end }}
 `))
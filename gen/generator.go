@@ -12,14 +12,34 @@ import (
 	"text/template"
 )
 
+// Codec for request and response bodies in generated code.
+type Codec string
+
+// Supported codecs.
+const (
+	CodecJSON     Codec = "json"
+	CodecMsgpack  Codec = "msgpack"  // github.com/vmihailenco/msgpack/v5
+	CodecProtobuf Codec = "protobuf" // google.golang.org/protobuf, all request and response types must be proto.Message, requests passed by reference
+	CodecCustom   Codec = "custom"   // user supplied, see Config.CustomCodec
+)
+
 // Config generator configuration
 type Config struct {
 	ServiceType      reflect.Type
 	NsqTopic         string
 	TransportTimeout int
-	apiPkgDir        string
-	nsqPkgDir        string
-	apiPkgPath       string
+	// Codec for request and response bodies, default CodecJSON.
+	Codec Codec
+	// CustomCodec name of the package level variable in api package
+	// which implements codec interface:
+	//   Name() string
+	//   Marshal(v interface{}) ([]byte, error)
+	//   Unmarshal(data []byte, v interface{}) error
+	// Setting it implies CodecCustom.
+	CustomCodec string
+	apiPkgDir   string
+	nsqPkgDir   string
+	apiPkgPath  string
 }
 
 func (c *Config) check() error {
@@ -32,6 +52,20 @@ func (c *Config) check() error {
 	if c.TransportTimeout == 0 {
 		c.TransportTimeout = 60
 	}
+	if c.CustomCodec != "" {
+		c.Codec = CodecCustom
+	}
+	switch c.Codec {
+	case "":
+		c.Codec = CodecJSON
+	case CodecJSON, CodecMsgpack, CodecProtobuf:
+	case CodecCustom:
+		if c.CustomCodec == "" {
+			return errors.New("missing CustomCodec attribute")
+		}
+	default:
+		return fmt.Errorf("unknown codec %s", c.Codec)
+	}
 	c.apiPkgDir = "api"
 	c.nsqPkgDir = "api/nsq"
 	c.apiPkgPath = c.ServiceType.PkgPath() + "/" + c.apiPkgDir
@@ -40,19 +74,24 @@ func (c *Config) check() error {
 
 // data collects atributes for template execution
 type data struct {
-	Package    string
-	Struct     string
-	Methods    []method
-	Errors     []string
-	NsqTopic   string
-	Timeout    int
-	ApiPkgPath string
+	Package     string
+	Struct      string
+	Methods     []method
+	Errors      []string
+	NsqTopic    string
+	Timeout     int
+	ApiPkgPath  string
+	Codec       Codec
+	CustomCodec string
 }
 
 type method struct {
 	Name      string
 	In        string
 	InWithPkg string
+	// InPointer input arg is passed by reference (protobuf messages can't
+	// be copied).
+	InPointer bool
 	Out       string
 }
 
@@ -80,13 +119,15 @@ func Generate(c Config) error {
 	}
 	pkg, stc := g.packageStruct()
 	g.data = data{
-		Package:    pkg,
-		Struct:     stc,
-		Methods:    ms,
-		Errors:     es,
-		NsqTopic:   c.NsqTopic,
-		Timeout:    c.TransportTimeout,
-		ApiPkgPath: c.apiPkgPath,
+		Package:     pkg,
+		Struct:      stc,
+		Methods:     ms,
+		Errors:      es,
+		NsqTopic:    c.NsqTopic,
+		Timeout:     c.TransportTimeout,
+		ApiPkgPath:  c.apiPkgPath,
+		Codec:       c.Codec,
+		CustomCodec: c.CustomCodec,
 	}
 	// execute templates
 	if err := g.execTemplate(apiTemplate, c.apiPkgDir+"/api_gen.go"); err != nil {
@@ -124,11 +165,15 @@ func (g *Generator) findMethods() ([]method, error) {
 	for i := 0; i < v.NumMethod(); i++ {
 		tm := v.Type().Method(i)
 
-		if tm.Name == "Serve" {
+		m := v.Method(i)
+
+		if tm.Name == "Serve" || isGeneratedCodec(tm.Name, m.Type()) {
 			fmt.Printf("skipping generated method %s\n", tm.Name)
 			continue
 		}
-		m := v.Method(i)
+		if tm.Name == "Codec" {
+			return nil, errors.New("method Codec collides with generated Codec method, rename it")
+		}
 
 		if m.Type().NumIn() != 2 &&
 			m.Type().NumOut() != 2 {
@@ -144,7 +189,12 @@ func (g *Generator) findMethods() ([]method, error) {
 		in := m.Type().In(1).String()
 		out := m.Type().Out(0).String()
 
-		if isPointer(in) {
+		if g.c.Codec == CodecProtobuf {
+			if !isPointer(in) {
+				fmt.Printf("skipping method %s, protobuf codec requires input arg passed by reference\n", tm.Name)
+				continue
+			}
+		} else if isPointer(in) {
 			fmt.Printf("skipping method %s, input arg must be passed by value\n", tm.Name)
 			continue
 		}
@@ -152,17 +202,36 @@ func (g *Generator) findMethods() ([]method, error) {
 			fmt.Printf("skipping method %s, output arg must be passed by reference\n", tm.Name)
 			continue
 		}
+		if g.c.Codec == CodecProtobuf &&
+			(!isProtoMessage(m.Type().In(1).Elem()) || !isProtoMessage(m.Type().Out(0).Elem())) {
+			fmt.Printf("skipping method %s, protobuf codec requires proto.Message arguments\n", tm.Name)
+			continue
+		}
 
 		ms = append(ms, method{
 			Name:      tm.Name,
-			InWithPkg: in,
-			In:        removePackagePrefix(in),
+			InWithPkg: removePointerPrefix(in),
+			In:        removePackagePrefix(removePointerPrefix(in)),
+			InPointer: isPointer(in),
 			Out:       removePackagePrefix(removePointerPrefix(out)),
 		})
 	}
 	return ms, nil
 }
 
+// isGeneratedCodec checks whether method is Codec() string generated into
+// the service.
+func isGeneratedCodec(name string, typ reflect.Type) bool {
+	return name == "Codec" && typ.NumIn() == 0 && typ.NumOut() == 1 &&
+		typ.Out(0).Kind() == reflect.String
+}
+
+// isProtoMessage checks whether pointer to typ implements proto.Message.
+func isProtoMessage(typ reflect.Type) bool {
+	_, ok := reflect.PtrTo(typ).MethodByName("ProtoReflect")
+	return ok
+}
+
 func isPointer(typ string) bool {
 	return strings.HasPrefix(typ, "*")
 }
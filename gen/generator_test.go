@@ -0,0 +1,127 @@
+package gen
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"go/format"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"text/template"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+type testReq struct{ X, Y int }
+type testRsp struct{ Z int }
+
+type testService struct{}
+
+func (*testService) Add(ctx context.Context, req testReq) (*testRsp, error) { return nil, nil }
+func (*testService) Pointer(ctx context.Context, req *testReq) (*testRsp, error) {
+	return nil, nil
+}
+
+// generated methods
+func (*testService) Codec() string { return "" }
+func (*testService) Serve(ctx context.Context, method string, buf []byte) ([]byte, error) {
+	return nil, nil
+}
+
+// protoReq and protoRsp stand for generated proto messages, which must not
+// be copied.
+type protoReq struct{ X, Y int }
+type protoRsp struct{ Z int }
+
+func (*protoReq) ProtoReflect() {}
+func (*protoRsp) ProtoReflect() {}
+
+type protoService struct{}
+
+func (*protoService) Add(ctx context.Context, req *protoReq) (*protoRsp, error) { return nil, nil }
+func (*protoService) Value(ctx context.Context, req protoReq) (*protoRsp, error) {
+	return nil, nil
+}
+func (*protoService) NotProto(ctx context.Context, req *testReq) (*testRsp, error) {
+	return nil, nil
+}
+
+type codecService struct{}
+
+func (*codecService) Codec(ctx context.Context, req testReq) (*testRsp, error) { return nil, nil }
+
+func testGenerator(t *testing.T, c Config) *Generator {
+	if c.ServiceType == nil {
+		c.ServiceType = reflect.TypeOf(testService{})
+	}
+	c.NsqTopic = "test.req"
+	assert.Nil(t, c.check())
+	g := &Generator{c: c}
+	ms, err := g.findMethods()
+	assert.Nil(t, err)
+	pkg, stc := g.packageStruct()
+	g.data = data{
+		Package:     pkg,
+		Struct:      stc,
+		Methods:     ms,
+		Errors:      []string{"Overflow"},
+		NsqTopic:    c.NsqTopic,
+		Timeout:     c.TransportTimeout,
+		ApiPkgPath:  c.apiPkgPath,
+		Codec:       c.Codec,
+		CustomCodec: c.CustomCodec,
+	}
+	return g
+}
+
+// golden compares template output with testdata/name, -update rewrites it.
+func golden(t *testing.T, g *Generator, tpl *template.Template, name string) {
+	var buf bytes.Buffer
+	assert.Nil(t, tpl.Execute(&buf, g.data))
+	src, err := format.Source(buf.Bytes())
+	assert.Nil(t, err)
+	fn := filepath.Join("testdata", name)
+	if *update {
+		assert.Nil(t, ioutil.WriteFile(fn, src, 0644))
+	}
+	expected, err := ioutil.ReadFile(fn)
+	assert.Nil(t, err)
+	assert.Equal(t, string(expected), string(src))
+}
+
+func TestFindMethods(t *testing.T) {
+	g := testGenerator(t, Config{})
+	assert.Len(t, g.data.Methods, 1)
+	assert.Equal(t, method{Name: "Add", InWithPkg: "gen.testReq", In: "testReq", Out: "testRsp"}, g.data.Methods[0])
+
+	// protobuf requests are passed by reference
+	g = testGenerator(t, Config{Codec: CodecProtobuf, ServiceType: reflect.TypeOf(protoService{})})
+	assert.Len(t, g.data.Methods, 1)
+	assert.Equal(t, method{Name: "Add", InWithPkg: "gen.protoReq", In: "protoReq", InPointer: true, Out: "protoRsp"}, g.data.Methods[0])
+
+	// rpc method named Codec would collide with generated one
+	g = &Generator{c: Config{ServiceType: reflect.TypeOf(codecService{})}}
+	_, err := g.findMethods()
+	assert.NotNil(t, err)
+}
+
+func TestTemplates(t *testing.T) {
+	g := testGenerator(t, Config{})
+	golden(t, g, apiTemplate, "api_gen.golden")
+	golden(t, g, nsqTemplate, "nsq_gen.golden")
+	golden(t, g, serviceTemplate, "service_gen.golden")
+
+	g = testGenerator(t, Config{Codec: CodecMsgpack})
+	golden(t, g, apiTemplate, "api_gen_msgpack.golden")
+
+	g = testGenerator(t, Config{CustomCodec: "Codec"})
+	golden(t, g, apiTemplate, "api_gen_custom.golden")
+
+	g = testGenerator(t, Config{Codec: CodecProtobuf, ServiceType: reflect.TypeOf(protoService{})})
+	golden(t, g, apiTemplate, "api_gen_protobuf.golden")
+	golden(t, g, serviceTemplate, "service_gen_protobuf.golden")
+}
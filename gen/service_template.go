@@ -7,22 +7,40 @@ package {{.Package}}
 
 import (
 	"context"
+{{- if .Errors }}
+	"errors"
+{{- end }}
 	"fmt"
 
   "{{.ApiPkgPath}}"
+{{- if .Errors }}
+	"github.com/minus5/nsqm/rpc"
+{{- end }}
 )
 
+// Codec returns name of the codec expected in request bodies.
+func (s *{{.Struct}}) Codec() string {
+	return api.CodecName
+}
+
 func (s *{{.Struct}}) Serve(ctx context.Context, method string, buf []byte) ([]byte, error) {
   switch method {
   {{- range .Methods }}
 	case api.Method{{.Name}}:
+{{- if .InPointer }}
+		req := new({{.InWithPkg}})
+		if err := api.Unmarshal(buf, req); err != nil {
+			return nil, err
+		}
+{{- else }}
 		var req {{.InWithPkg}}
 		if err := api.Unmarshal(buf, &req); err != nil {
 			return nil, err
 		}
+{{- end }}
 		rsp, err := s.{{.Name}}(ctx, req)
 		if err != nil {
-			return nil, err
+			return nil, appError(err)
 		}
 		return api.Marshal(rsp)
   {{- end }}
@@ -30,4 +48,15 @@ func (s *{{.Struct}}) Serve(ctx context.Context, method string, buf []byte) ([]b
 		return nil, fmt.Errorf("unknown method %s", method)
 	}
 }
+
+// appError converts errors declared in api package into structured errors
+// with error name as code, so client can match them by code.
+func appError(err error) error {
+{{- range .Errors }}
+	if errors.Is(err, api.{{ . }}) {
+		return &rpc.Error{Code: "{{ . }}", Message: err.Error()}
+	}
+{{- end }}
+	return err
+}
 `))
@@ -0,0 +1,188 @@
+package nsqm
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	nsq "github.com/nsqio/go-nsq"
+)
+
+// Status of the component health.
+type Status string
+
+// Health statuses, from best to worst.
+const (
+	// StatusUp component is working.
+	StatusUp Status = "up"
+	// StatusDegraded component is working with reduced capacity, e.g.
+	// consumer without nsqd connections or failing discovery.
+	StatusDegraded Status = "degraded"
+	// StatusDown component is not working.
+	StatusDown Status = "down"
+)
+
+var statusRank = map[Status]int{StatusUp: 0, StatusDegraded: 1, StatusDown: 2}
+
+func (s Status) worse(o Status) bool {
+	return statusRank[s] > statusRank[o]
+}
+
+// Health of the component and its parts.
+// Status is the worst status of the component and its parts.
+type Health struct {
+	Name       string                 `json:"name"`
+	Status     Status                 `json:"status"`
+	Error      string                 `json:"error,omitempty"`
+	Details    map[string]interface{} `json:"details,omitempty"`
+	Components []Health               `json:"components,omitempty"`
+}
+
+func newHealth(name string, components ...Health) Health {
+	h := Health{Name: name, Status: StatusUp}
+	for _, c := range components {
+		h.add(c)
+	}
+	return h
+}
+
+// add adds part of the component.
+func (h *Health) add(c Health) {
+	h.Components = append(h.Components, c)
+	if c.Status.worse(h.Status) {
+		h.Status = c.Status
+	}
+}
+
+// fail sets status and error of the component.
+func (h *Health) fail(s Status, err error) {
+	if s.worse(h.Status) {
+		h.Status = s
+	}
+	h.Error = err.Error()
+}
+
+// pinger is implemented by producers which can check connection to nsqd,
+// like *nsq.Producer.
+type pinger interface {
+	Ping() error
+}
+
+// statser is implemented by consumers which report connection stats,
+// like *nsq.Consumer.
+type statser interface {
+	Stats() *nsq.ConsumerStats
+}
+
+// errer is implemented by discoveries which report their last error.
+type errer interface {
+	Err() error
+}
+
+var errNoConnections = errors.New("no nsqd connections")
+
+// ProducerHealth checks producer connection to nsqd with Ping.
+// Producer down if Ping fails.
+// Ping of *nsq.Producer is a round trip to nsqd (NOP command) on each call,
+// and connects to nsqd when producer is not connected, so probes calling
+// Health should not be too frequent.
+func ProducerHealth(p Producer) Health {
+	h := newHealth("producer")
+	if pp, ok := p.(pinger); ok {
+		if err := pp.Ping(); err != nil {
+			h.fail(StatusDown, err)
+		}
+	}
+	return h
+}
+
+// ConsumerHealth reports consumer connection stats.
+// Consumer without nsqd connections is degraded, consumer connected to
+// lookupds has no connections until topic is created on some nsqd.
+func ConsumerHealth(c *nsq.Consumer) Health {
+	return consumerHealth("consumer", c)
+}
+
+func consumerHealth(name string, c interface{}) Health {
+	h := newHealth(name)
+	s, ok := c.(statser)
+	if !ok {
+		return h
+	}
+	stats := s.Stats()
+	h.Details = map[string]interface{}{
+		"connections": stats.Connections,
+		"received":    stats.MessagesReceived,
+		"finished":    stats.MessagesFinished,
+		"requeued":    stats.MessagesRequeued,
+	}
+	if stats.Connections == 0 {
+		h.fail(StatusDegraded, errNoConnections)
+	}
+	return h
+}
+
+// Health reports status of the discovery. Discovery is degraded when its
+// last query failed.
+func (c *Config) Health() Health {
+	h := newHealth("discovery")
+	if c.dcy == nil {
+		h.Details = map[string]interface{}{"nsqd": c.NSQDAddress}
+		return h
+	}
+	h.Details = map[string]interface{}{"lookupds": c.NSQLookupdAddresses}
+	if e, ok := c.dcy.(errer); ok {
+		if err := e.Err(); err != nil {
+			h.fail(StatusDegraded, err)
+		}
+	}
+	return h
+}
+
+// Health reports status of the client producer, reply consumer and
+// discovery. Closed client is down.
+func (c *RpcClient) Health() Health {
+	t := c.transport
+	h := newHealth("rpc client "+c.reqTopic,
+		ProducerHealth(t.producer),
+		consumerHealth("reply consumer", t.consumer),
+		t.cfg.Health())
+	h.Details = map[string]interface{}{"pending": c.handler.Pending()}
+	if c.isClosed() {
+		h.fail(StatusDown, ErrClientClosed)
+	}
+	return h
+}
+
+// Health reports status of the server producer, request consumers and
+// discovery. Server is down after Stop, Close or Shutdown.
+func (s *RpcServer) Health() Health {
+	h := newHealth("rpc server "+s.reqTopic, ProducerHealth(s.producer))
+	for _, c := range s.consumers {
+		h.add(consumerHealth("request consumer", c))
+	}
+	h.add(s.cfg.Health())
+	h.Details = map[string]interface{}{"in_flight": s.server.InFlight()}
+	if s.isStopped() {
+		h.fail(StatusDown, ErrServerStopped)
+	}
+	return h
+}
+
+// HealthHandler serves health of the components as JSON, for liveness and
+// readiness probes. Responds with 503 status when any component is down.
+//
+//	http.Handle("/health", nsqm.HealthHandler(client.Health, server.Health))
+func HealthHandler(components ...func() Health) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := newHealth("nsqm")
+		for _, c := range components {
+			h.add(c())
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if h.Status == StatusDown {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(h)
+	})
+}
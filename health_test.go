@@ -0,0 +1,66 @@
+package nsqm
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	nsq "github.com/nsqio/go-nsq"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeProducer struct {
+	Producer
+	err error
+}
+
+func (p fakeProducer) Ping() error { return p.err }
+
+type fakeConsumer struct {
+	Consumer
+	connections int
+}
+
+func (c fakeConsumer) Stats() *nsq.ConsumerStats {
+	return &nsq.ConsumerStats{Connections: c.connections}
+}
+
+func TestHealth(t *testing.T) {
+	assert.Equal(t, StatusUp, ProducerHealth(fakeProducer{}).Status)
+	h := ProducerHealth(fakeProducer{err: errors.New("connection refused")})
+	assert.Equal(t, StatusDown, h.Status)
+	assert.Equal(t, "connection refused", h.Error)
+
+	assert.Equal(t, StatusUp, consumerHealth("consumer", fakeConsumer{connections: 1}).Status)
+	h = consumerHealth("consumer", fakeConsumer{})
+	assert.Equal(t, StatusDegraded, h.Status)
+	assert.Equal(t, 0, h.Details["connections"])
+
+	h = newHealth("server", newHealth("a"), consumerHealth("b", fakeConsumer{}))
+	assert.Equal(t, StatusDegraded, h.Status)
+}
+
+func TestHealthHandler(t *testing.T) {
+	up := func() Health { return newHealth("up") }
+	degraded := func() Health { return consumerHealth("consumer", fakeConsumer{}) }
+	down := func() Health { return ProducerHealth(fakeProducer{err: errors.New("connection refused")}) }
+
+	get := func(h http.Handler) (int, Health) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/health", nil))
+		var rsp Health
+		assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &rsp))
+		return w.Code, rsp
+	}
+	code, h := get(HealthHandler(up, degraded))
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, StatusDegraded, h.Status)
+	assert.Len(t, h.Components, 2)
+
+	code, h = get(HealthHandler(up, down))
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, StatusDown, h.Status)
+	assert.Equal(t, "connection refused", h.Components[1].Error)
+}
@@ -0,0 +1,122 @@
+// Package log defines structured logger used by nsqm, rpc and discovery
+// packages, with adapters to other loggers.
+package log
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Level of the log entry.
+type Level int
+
+// Log levels.
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DBG"
+	case LevelInfo:
+		return "INF"
+	case LevelWarn:
+		return "WRN"
+	case LevelError:
+		return "ERR"
+	}
+	return fmt.Sprintf("LEVEL(%d)", int(l))
+}
+
+// Logger structured logger.
+// Fields are alternating keys and values, as in log/slog.
+type Logger interface {
+	Log(level Level, msg string, fields ...interface{})
+}
+
+// Nop logger discards all entries.
+var Nop Logger = nop{}
+
+type nop struct{}
+
+func (nop) Log(level Level, msg string, fields ...interface{}) {}
+
+// Outputer logger with go-nsq Output(calldepth, s) signature, like *log.Logger.
+type Outputer interface {
+	Output(calldepth int, s string) error
+}
+
+// FromOutput creates Logger which writes entries of level min and above to
+// Outputer.
+// Entries are formatted as level, message and key=value fields:
+//
+//	WRN request expired method=Add correlation_id=42
+func FromOutput(o Outputer, min Level) Logger {
+	return &output{o: o, min: min}
+}
+
+type output struct {
+	o   Outputer
+	min Level
+}
+
+func (l *output) Log(level Level, msg string, fields ...interface{}) {
+	if level < l.min {
+		return
+	}
+	l.o.Output(2, Format(level, msg, fields...))
+}
+
+// Format formats entry as level, message and key=value fields.
+func Format(level Level, msg string, fields ...interface{}) string {
+	var b strings.Builder
+	b.WriteString(level.String())
+	b.WriteString(" ")
+	b.WriteString(msg)
+	for i := 0; i < len(fields); i += 2 {
+		if i+1 == len(fields) {
+			fmt.Fprintf(&b, " !BADKEY=%v", fields[i])
+			break
+		}
+		v := fmt.Sprint(fields[i+1])
+		if strings.ContainsAny(v, " \t\n\"=") {
+			v = fmt.Sprintf("%q", v)
+		}
+		fmt.Fprintf(&b, " %v=%s", fields[i], v)
+	}
+	return b.String()
+}
+
+// NSQ adapts Logger to go-nsq producer and consumer SetLogger.
+func NSQ(l Logger) *NSQLogger {
+	return &NSQLogger{l}
+}
+
+// NSQLogger go-nsq logger which writes to Logger.
+type NSQLogger struct {
+	l Logger
+}
+
+var nsqLevels = map[string]Level{
+	"DBG": LevelDebug,
+	"INF": LevelInfo,
+	"WRN": LevelWarn,
+	"ERR": LevelError,
+}
+
+// Output implements go-nsq logger. Level is taken from the line prefix.
+func (n *NSQLogger) Output(calldepth int, s string) error {
+	level := LevelInfo
+	if len(s) >= 3 {
+		if l, ok := nsqLevels[s[:3]]; ok {
+			level = l
+			s = strings.TrimLeft(s[3:], " ")
+		}
+	}
+	n.l.Log(level, s)
+	return nil
+}
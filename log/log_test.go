@@ -0,0 +1,45 @@
+package log
+
+import (
+	"bytes"
+	stdlog "log"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type recordLogger struct {
+	lines []string
+}
+
+func (r *recordLogger) Log(level Level, msg string, fields ...interface{}) {
+	r.lines = append(r.lines, Format(level, msg, fields...))
+}
+
+func TestFormat(t *testing.T) {
+	assert.Equal(t, "WRN request expired method=Add correlation_id=42",
+		Format(LevelWarn, "request expired", "method", "Add", "correlation_id", 42))
+	assert.Equal(t, `ERR failed error="no route" !BADKEY=x`,
+		Format(LevelError, "failed", "error", "no route", "x"))
+}
+
+func TestFromOutput(t *testing.T) {
+	var buf bytes.Buffer
+	l := FromOutput(stdlog.New(&buf, "", stdlog.Lshortfile), LevelInfo)
+	l.Log(LevelDebug, "skipped")
+	l.Log(LevelInfo, "connected", "addr", "127.0.0.1:4161")
+	assert.Equal(t, "log_test.go:30: INF connected addr=127.0.0.1:4161\n", buf.String())
+}
+
+func TestNSQ(t *testing.T) {
+	r := &recordLogger{}
+	n := NSQ(r)
+	n.Output(2, "ERR    1 [topic/channel] error connecting")
+	n.Output(2, "DBG    1 [topic/channel] got message")
+	n.Output(2, "no prefix")
+	assert.Equal(t, []string{
+		"ERR 1 [topic/channel] error connecting",
+		"DBG 1 [topic/channel] got message",
+		"INF no prefix",
+	}, r.lines)
+}
@@ -0,0 +1,457 @@
+// Package memory is in process replacement for nsqd, for testing rpc clients
+// and servers without running nsq.
+//
+// Broker keeps topics and channels in memory. As in nsqd each message
+// published to the topic is copied to all topic channels and delivered to
+// one of the channel consumers. Messages published before first channel is
+// created wait in the topic. Messages which are not finished in
+// MsgTimeout are requeued, channels with #ephemeral suffix are deleted
+// when their last consumer stops.
+package memory
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minus5/nsqm"
+	"github.com/nsqio/go-nsq"
+)
+
+// ErrStopped publish on stopped producer.
+var ErrStopped = errors.New("memory: producer stopped")
+
+const ephemeralSuffix = "#ephemeral"
+
+// Broker in memory nsqd.
+type Broker struct {
+	// MsgTimeout time after which not finished message is requeued,
+	// default 60s.
+	MsgTimeout time.Duration
+	// RequeueDelay delay for messages requeued by handler error, default 100ms.
+	RequeueDelay time.Duration
+	// MaxAttempts after which message is finished without calling the
+	// handler, default 5, negative for unlimited.
+	MaxAttempts int
+
+	topics map[string]*topic
+	msgID  uint64
+	sync.Mutex
+}
+
+// NewBroker creates empty broker with default settings.
+func NewBroker() *Broker {
+	return &Broker{
+		MsgTimeout:   time.Minute,
+		RequeueDelay: 100 * time.Millisecond,
+		MaxAttempts:  5,
+		topics:       make(map[string]*topic),
+	}
+}
+
+// Config returns nsqm local Config which uses broker as transport.
+func (b *Broker) Config() *nsqm.Config {
+	cfg := nsqm.Local()
+	cfg.Transport = b
+	return cfg
+}
+
+// NewProducer creates producer which publishes to the broker.
+func (b *Broker) NewProducer() (nsqm.Producer, error) {
+	return &Producer{b: b}, nil
+}
+
+// NewConsumer creates consumer of the topic channel, with concurrency
+// handler goroutines. Topic and channel are created if not existing.
+func (b *Broker) NewConsumer(topic, channel string, handler nsq.Handler, concurrency int) (nsqm.Consumer, error) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	ch := b.channel(topic, channel)
+	c := &Consumer{
+		ch:       ch,
+		handler:  handler,
+		stop:     make(chan struct{}),
+		StopChan: make(chan int),
+	}
+	ch.addConsumer()
+	c.wg.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go c.handlerLoop()
+	}
+	return c, nil
+}
+
+// Depth returns number of messages waiting in the topic channel, not
+// counting messages in flight. When channel is empty returns number of
+// messages waiting in the topic for the first channel.
+func (b *Broker) Depth(topic, channel string) int {
+	b.Lock()
+	t, ok := b.topics[topic]
+	b.Unlock()
+	if !ok {
+		return 0
+	}
+	t.Lock()
+	defer t.Unlock()
+	ch, ok := t.channels[channel]
+	if !ok {
+		return len(t.pending)
+	}
+	ch.Lock()
+	defer ch.Unlock()
+	return len(ch.queue)
+}
+
+// Topics returns names of existing topics.
+func (b *Broker) Topics() []string {
+	b.Lock()
+	defer b.Unlock()
+	var names []string
+	for n := range b.topics {
+		names = append(names, n)
+	}
+	return names
+}
+
+func (b *Broker) topic(name string) *topic {
+	b.Lock()
+	defer b.Unlock()
+	t, ok := b.topics[name]
+	if !ok {
+		t = &topic{b: b, name: name, channels: make(map[string]*channel)}
+		b.topics[name] = t
+	}
+	return t
+}
+
+func (b *Broker) channel(topic, name string) *channel {
+	t := b.topic(topic)
+	t.Lock()
+	defer t.Unlock()
+	ch, ok := t.channels[name]
+	if !ok {
+		ch = &channel{
+			b:        b,
+			t:        t,
+			name:     name,
+			notify:   make(chan struct{}, 1),
+			inFlight: make(map[nsq.MessageID]*time.Timer),
+		}
+		t.channels[name] = ch
+		// first channel gets messages waiting in the topic
+		for _, m := range t.pending {
+			ch.push(m)
+		}
+		t.pending = nil
+	}
+	return ch
+}
+
+func (b *Broker) publish(topic string, body []byte) {
+	b.topic(topic).publish(b.newMessage(body))
+}
+
+func (b *Broker) newMessage(body []byte) *message {
+	b.Lock()
+	defer b.Unlock()
+	b.msgID++
+	var id nsq.MessageID
+	const hex = "0123456789abcdef"
+	for i, n := len(id)-1, b.msgID; i >= 0; i, n = i-1, n>>4 {
+		id[i] = hex[n&0xf]
+	}
+	return &message{id: id, body: body, timestamp: time.Now().UnixNano()}
+}
+
+// message stored in the channel queue
+type message struct {
+	id        nsq.MessageID
+	body      []byte
+	timestamp int64
+	attempts  uint16
+}
+
+type topic struct {
+	b        *Broker
+	name     string
+	channels map[string]*channel
+	pending  []*message
+	sync.Mutex
+}
+
+// publish copies message to all channels.
+func (t *topic) publish(m *message) {
+	t.Lock()
+	defer t.Unlock()
+	if len(t.channels) == 0 {
+		t.pending = append(t.pending, m)
+		return
+	}
+	for _, ch := range t.channels {
+		c := *m
+		ch.push(&c)
+	}
+}
+
+func (t *topic) removeChannel(name string) {
+	t.Lock()
+	defer t.Unlock()
+	delete(t.channels, name)
+}
+
+// channel queue of messages delivered to channel consumers.
+type channel struct {
+	b         *Broker
+	t         *topic
+	name      string
+	queue     []*message
+	notify    chan struct{}
+	inFlight  map[nsq.MessageID]*time.Timer
+	consumers int
+	sync.Mutex
+}
+
+func (ch *channel) push(m *message) {
+	ch.Lock()
+	ch.queue = append(ch.queue, m)
+	ch.Unlock()
+	ch.signal()
+}
+
+func (ch *channel) signal() {
+	select {
+	case ch.notify <- struct{}{}:
+	default:
+	}
+}
+
+// pop waits for next message, returns nil when stop is closed.
+func (ch *channel) pop(stop <-chan struct{}) *nsq.Message {
+	for {
+		ch.Lock()
+		if len(ch.queue) > 0 {
+			m := ch.queue[0]
+			ch.queue = ch.queue[1:]
+			if len(ch.queue) > 0 {
+				// wake up other consumer
+				ch.signal()
+			}
+			msg := ch.deliver(m)
+			ch.Unlock()
+			return msg
+		}
+		ch.Unlock()
+		select {
+		case <-ch.notify:
+		case <-stop:
+			return nil
+		}
+	}
+}
+
+// deliver marks message as in flight, must be called under lock.
+func (ch *channel) deliver(m *message) *nsq.Message {
+	m.attempts++
+	msg := &nsq.Message{
+		ID:          m.id,
+		Body:        m.body,
+		Timestamp:   m.timestamp,
+		Attempts:    m.attempts,
+		NSQDAddress: "memory",
+		Delegate:    &delegate{ch: ch, m: m},
+	}
+	ch.inFlight[m.id] = time.AfterFunc(ch.b.MsgTimeout, func() {
+		if ch.done(m.id) {
+			ch.push(m)
+		}
+	})
+	return msg
+}
+
+// done removes message from in flight, returns false if message is not in flight.
+func (ch *channel) done(id nsq.MessageID) bool {
+	ch.Lock()
+	defer ch.Unlock()
+	t, ok := ch.inFlight[id]
+	if ok {
+		t.Stop()
+		delete(ch.inFlight, id)
+	}
+	return ok
+}
+
+func (ch *channel) touch(id nsq.MessageID) {
+	ch.Lock()
+	defer ch.Unlock()
+	if t, ok := ch.inFlight[id]; ok {
+		t.Reset(ch.b.MsgTimeout)
+	}
+}
+
+func (ch *channel) requeue(m *message, delay time.Duration) {
+	if !ch.done(m.id) {
+		return
+	}
+	if delay < 0 {
+		delay = ch.b.RequeueDelay
+	}
+	if delay == 0 {
+		ch.push(m)
+		return
+	}
+	time.AfterFunc(delay, func() { ch.push(m) })
+}
+
+func (ch *channel) addConsumer() {
+	ch.Lock()
+	defer ch.Unlock()
+	ch.consumers++
+}
+
+// removeConsumer deletes ephemeral channel after its last consumer.
+func (ch *channel) removeConsumer() {
+	ch.Lock()
+	ch.consumers--
+	last := ch.consumers == 0
+	ch.Unlock()
+	if last && strings.HasSuffix(ch.name, ephemeralSuffix) {
+		ch.t.removeChannel(ch.name)
+	}
+}
+
+// delegate handles Finish, Requeue and Touch of the delivered message.
+type delegate struct {
+	ch *channel
+	m  *message
+}
+
+func (d *delegate) OnFinish(*nsq.Message) { d.ch.done(d.m.id) }
+func (d *delegate) OnTouch(*nsq.Message)  { d.ch.touch(d.m.id) }
+func (d *delegate) OnRequeue(_ *nsq.Message, delay time.Duration, _ bool) {
+	d.ch.requeue(d.m, delay)
+}
+
+// Producer publishes messages to the broker.
+type Producer struct {
+	b       *Broker
+	stopped bool
+	sync.Mutex
+}
+
+func (p *Producer) check() error {
+	p.Lock()
+	defer p.Unlock()
+	if p.stopped {
+		return ErrStopped
+	}
+	return nil
+}
+
+// Publish publishes message to topic.
+func (p *Producer) Publish(topic string, body []byte) error {
+	if err := p.check(); err != nil {
+		return err
+	}
+	p.b.publish(topic, body)
+	return nil
+}
+
+// MultiPublish publishes messages to topic.
+func (p *Producer) MultiPublish(topic string, body [][]byte) error {
+	if err := p.check(); err != nil {
+		return err
+	}
+	for _, b := range body {
+		p.b.publish(topic, b)
+	}
+	return nil
+}
+
+// DeferredPublish publishes message to topic after delay.
+func (p *Producer) DeferredPublish(topic string, delay time.Duration, body []byte) error {
+	if err := p.check(); err != nil {
+		return err
+	}
+	time.AfterFunc(delay, func() { p.b.publish(topic, body) })
+	return nil
+}
+
+// PublishAsync publishes message to topic and calls done, implements
+// rpc.AsyncPublisher.
+func (p *Producer) PublishAsync(topic string, body []byte, done func(error)) error {
+	if err := p.check(); err != nil {
+		return err
+	}
+	p.b.publish(topic, body)
+	go done(nil)
+	return nil
+}
+
+// Ping returns ErrStopped when producer is stopped, as nsq.Producer Ping.
+func (p *Producer) Ping() error {
+	return p.check()
+}
+
+// Stop stops producer, later publishes return ErrStopped.
+func (p *Producer) Stop() {
+	p.Lock()
+	defer p.Unlock()
+	p.stopped = true
+}
+
+// Consumer receives messages from the broker channel.
+type Consumer struct {
+	ch       *channel
+	handler  nsq.Handler
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+	// StopChan is closed when consumer is stopped, as nsq.Consumer.StopChan.
+	StopChan chan int
+}
+
+// Stop stops receiving messages. Messages which are being processed are
+// completed, StopChan is closed after that.
+func (c *Consumer) Stop() {
+	c.stopOnce.Do(func() {
+		close(c.stop)
+		go func() {
+			c.wg.Wait()
+			c.ch.removeConsumer()
+			close(c.StopChan)
+		}()
+	})
+}
+
+// Done returns StopChan.
+func (c *Consumer) Done() <-chan int {
+	return c.StopChan
+}
+
+func (c *Consumer) handlerLoop() {
+	defer c.wg.Done()
+	for {
+		m := c.ch.pop(c.stop)
+		if m == nil {
+			return
+		}
+		if max := c.ch.b.MaxAttempts; max > 0 && int(m.Attempts) > max {
+			if l, ok := c.handler.(nsq.FailedMessageLogger); ok {
+				l.LogFailedMessage(m)
+			}
+			m.Finish()
+			continue
+		}
+		err := c.handler.HandleMessage(m)
+		if m.IsAutoResponseDisabled() {
+			continue
+		}
+		if err != nil {
+			m.Requeue(-1)
+			continue
+		}
+		m.Finish()
+	}
+}
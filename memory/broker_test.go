@@ -0,0 +1,114 @@
+package memory
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+	"github.com/stretchr/testify/assert"
+)
+
+type handler struct {
+	msgs chan *nsq.Message
+	err  error
+	sync.Mutex
+}
+
+func newHandler() *handler {
+	return &handler{msgs: make(chan *nsq.Message, 16)}
+}
+
+func (h *handler) HandleMessage(m *nsq.Message) error {
+	h.msgs <- m
+	h.Lock()
+	defer h.Unlock()
+	return h.err
+}
+
+func (h *handler) next(t *testing.T) *nsq.Message {
+	select {
+	case m := <-h.msgs:
+		return m
+	case <-time.After(time.Second):
+		t.Fatal("message not received")
+	}
+	return nil
+}
+
+func TestBrokerChannels(t *testing.T) {
+	b := NewBroker()
+	p, _ := b.NewProducer()
+	// waits in topic for the first channel
+	assert.Nil(t, p.Publish("topic", []byte("first")))
+	assert.Equal(t, 1, b.Depth("topic", "ch1"))
+
+	h1, h2 := newHandler(), newHandler()
+	c1, _ := b.NewConsumer("topic", "ch1", h1, 1)
+	assert.Equal(t, "first", string(h1.next(t).Body))
+	c2, _ := b.NewConsumer("topic", "ch2", h2, 1)
+
+	// each channel gets copy
+	assert.Nil(t, p.Publish("topic", []byte("second")))
+	assert.Equal(t, "second", string(h1.next(t).Body))
+	assert.Equal(t, "second", string(h2.next(t).Body))
+
+	c1.Stop()
+	c2.Stop()
+	<-c1.Done()
+	<-c2.Done()
+	p.Stop()
+	assert.Equal(t, ErrStopped, p.Publish("topic", nil))
+}
+
+func TestBrokerRequeue(t *testing.T) {
+	b := NewBroker()
+	b.RequeueDelay = time.Millisecond
+	b.MaxAttempts = 2
+	p, _ := b.NewProducer()
+	h := newHandler()
+	h.err = errors.New("failed")
+	c, _ := b.NewConsumer("topic", "ch", h, 2)
+	defer c.Stop()
+
+	assert.Nil(t, p.Publish("topic", []byte("body")))
+	m := h.next(t)
+	assert.Equal(t, uint16(1), m.Attempts)
+	// requeued on handler error
+	m = h.next(t)
+	assert.Equal(t, uint16(2), m.Attempts)
+	// not delivered after MaxAttempts
+	select {
+	case <-h.msgs:
+		t.Fatal("delivered after max attempts")
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestBrokerMsgTimeout(t *testing.T) {
+	b := NewBroker()
+	b.MsgTimeout = 10 * time.Millisecond
+	p, _ := b.NewProducer()
+	h := &handler{msgs: make(chan *nsq.Message, 16)}
+	c, _ := b.NewConsumer("topic", "ch", nsq.HandlerFunc(func(m *nsq.Message) error {
+		m.DisableAutoResponse() // never finished
+		return h.HandleMessage(m)
+	}), 1)
+	defer c.Stop()
+
+	assert.Nil(t, p.Publish("topic", []byte("body")))
+	assert.Equal(t, uint16(1), h.next(t).Attempts)
+	assert.Equal(t, uint16(2), h.next(t).Attempts)
+}
+
+func TestBrokerEphemeralChannel(t *testing.T) {
+	b := NewBroker()
+	c, _ := b.NewConsumer("topic", "ch#ephemeral", newHandler(), 1)
+	c.Stop()
+	<-c.Done()
+	p, _ := b.NewProducer()
+	assert.Nil(t, p.Publish("topic", []byte("body")))
+	// channel is deleted, message waits in topic
+	assert.Equal(t, 1, b.Depth("topic", "ch#ephemeral"))
+}
@@ -0,0 +1,105 @@
+package memory
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/minus5/nsqm"
+	"github.com/minus5/nsqm/rpc"
+	"github.com/stretchr/testify/assert"
+)
+
+type echo struct{}
+
+func (echo) Serve(ctx context.Context, method string, req []byte) ([]byte, error) {
+	return append([]byte(method+" "), req...), nil
+}
+
+func TestRpc(t *testing.T) {
+	cfg := NewBroker().Config()
+	srv, err := nsqm.NewRpcServer(cfg, "echo.req", echo{})
+	assert.Nil(t, err)
+	c, err := nsqm.NewRpcClient(cfg, "echo.req")
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	rsp, appErr, err := c.Call(ctx, "Echo", []byte("hello"))
+	assert.Nil(t, err)
+	assert.Equal(t, "", appErr)
+	assert.Equal(t, "Echo hello", string(rsp))
+	assert.Equal(t, nsqm.StatusUp, c.Health().Status)
+	assert.Equal(t, nsqm.StatusUp, srv.Health().Status)
+
+	assert.Nil(t, c.Close())
+	assert.Equal(t, nsqm.StatusDown, c.Health().Status)
+	_, err = srv.Shutdown(ctx)
+	assert.Nil(t, err)
+	// producer is stopped
+	assert.Equal(t, nsqm.StatusDown, srv.Health().Status)
+}
+
+// adder service with json bodies and structured errors, same as generated
+// servers.
+type adder struct{}
+
+type addReq struct {
+	X, Y int
+}
+
+type addRsp struct {
+	Z int
+}
+
+func (adder) Codec() string { return "json" }
+
+func (adder) Serve(ctx context.Context, method string, buf []byte) ([]byte, error) {
+	if method != "Add" {
+		return nil, fmt.Errorf("unknown method %s", method)
+	}
+	var req addReq
+	if err := json.Unmarshal(buf, &req); err != nil {
+		return nil, err
+	}
+	if req.X+req.Y > 100 {
+		return nil, rpc.NewError("overflow", "overflow")
+	}
+	return json.Marshal(addRsp{Z: req.X + req.Y})
+}
+
+func TestService(t *testing.T) {
+	cfg := NewBroker().Config()
+	srv, err := nsqm.NewRpcServer(cfg, "adder.req", adder{})
+	assert.Nil(t, err)
+	defer srv.Close()
+	defer srv.Stop()
+	c, err := nsqm.NewRpcClient(cfg, "adder.req")
+	assert.Nil(t, err)
+	defer c.Close()
+	c.SetCodec("json")
+
+	add := func(x, y int) (int, error) {
+		buf, _ := json.Marshal(addReq{X: x, Y: y})
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		rspBuf, _, err := c.Call(ctx, "Add", buf)
+		if err != nil {
+			return 0, err
+		}
+		var rsp addRsp
+		err = json.Unmarshal(rspBuf, &rsp)
+		return rsp.Z, err
+	}
+	z, err := add(2, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, z)
+
+	_, err = add(100, 100)
+	var rerr *rpc.Error
+	assert.True(t, errors.As(err, &rerr))
+	assert.Equal(t, "overflow", rerr.Code)
+}
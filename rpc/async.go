@@ -0,0 +1,98 @@
+package rpc
+
+import (
+	"context"
+
+	"github.com/minus5/nsqm/log"
+	"github.com/pkg/errors"
+)
+
+// asyncPublisher publishes with AsyncPublisher, with at most window
+// publishes waiting for nsqd acknowledge.
+type asyncPublisher struct {
+	publishAsync func(topic string, body []byte, done func(error)) error
+	window       chan struct{}
+}
+
+func newAsyncPublisher(p Publisher, window int) *asyncPublisher {
+	ap, ok := p.(AsyncPublisher)
+	if window <= 0 || !ok {
+		return nil
+	}
+	return &asyncPublisher{
+		publishAsync: ap.PublishAsync,
+		window:       make(chan struct{}, window),
+	}
+}
+
+// publish starts publishing body to topic, blocks while window is full.
+// Done is called with the result when nsqd acknowledges publish.
+// Returns error if publish could not be started, done is not called then.
+func (a *asyncPublisher) publish(topic string, body []byte, done func(error)) error {
+	a.window <- struct{}{}
+	err := a.publishAsync(topic, body, func(err error) {
+		<-a.window
+		done(err)
+	})
+	if err != nil {
+		<-a.window
+	}
+	return err
+}
+
+// SetAsyncPublish enables publishing of requests with nsq PublishAsync, with
+// at most window requests waiting for nsqd acknowledge. Publish error is
+// returned as call result. Zero window, or publisher which doesn't implement
+// AsyncPublisher, publishes synchronously.
+// Batching, when enabled, is used instead.
+// Must be called before first request.
+func (c *Client) SetAsyncPublish(window int) {
+	c.async = newAsyncPublisher(c.publisher, window)
+}
+
+// startPublish publishes request, asynchronously if enabled. Result of the
+// asynchronous publish is sent to the returned channel.
+func (c *Client) startPublish(topic string, body []byte) (<-chan error, error) {
+	if c.async == nil || c.batching != nil {
+		return nil, c.publish(topic, body)
+	}
+	ch := make(chan error, 1)
+	err := c.async.publish(topic, body, func(err error) { ch <- err })
+	return ch, err
+}
+
+// SetAsyncPublish enables publishing of replies with nsq PublishAsync, with
+// at most window replies waiting for nsqd acknowledge. Handler doesn't wait
+// for acknowledge, message is finished when reply is published or requeued
+// if publish fails. Zero window, or publisher which doesn't implement
+// AsyncPublisher, publishes synchronously.
+// Must be called before server receives first message.
+func (s *Server) SetAsyncPublish(window int) {
+	s.async = newAsyncPublisher(s.producer, window)
+}
+
+// replyAsync publishes reply without waiting for nsqd acknowledge.
+// Drain waits for started publishes.
+func (s *Server) replyAsync(ctx context.Context, m Message, req, rsp *Envelope) error {
+	_, span := s.tracer.StartSpan(ctx, SpanProducer, req.ReplyTo, req.Method)
+	m.DisableAutoResponse()
+	s.inFlight.add()
+	err := s.async.publish(req.ReplyTo, rsp.Encode(), func(err error) {
+		span.End(err)
+		if err != nil {
+			s.logger.Log(log.LevelError, "reply publish failed", "method", req.Method, "correlation_id", req.CorrelationID, "topic", req.ReplyTo, "error", err)
+			m.Requeue(-1)
+		} else {
+			m.Finish()
+		}
+		s.inFlight.release()
+	})
+	if err != nil {
+		span.End(err)
+		s.logger.Log(log.LevelError, "reply publish failed", "method", req.Method, "correlation_id", req.CorrelationID, "topic", req.ReplyTo, "error", err)
+		m.Requeue(-1)
+		s.inFlight.release()
+		return errors.Wrap(err, "nsq publish failed")
+	}
+	return nil
+}
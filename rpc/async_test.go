@@ -0,0 +1,41 @@
+package rpc
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAsyncPublisherWindow(t *testing.T) {
+	pending := make(chan func(error), 10)
+	a := &asyncPublisher{
+		publishAsync: func(topic string, body []byte, done func(error)) error {
+			pending <- done
+			return nil
+		},
+		window: make(chan struct{}, 2),
+	}
+	results := make(chan error, 3)
+	done := func(err error) { results <- err }
+	assert.Nil(t, a.publish("t", nil, done))
+	assert.Nil(t, a.publish("t", nil, done))
+
+	// third publish waits for free slot in window
+	started := make(chan struct{})
+	go func() {
+		a.publish("t", nil, done)
+		close(started)
+	}()
+	select {
+	case <-started:
+		t.Fatal("window exceeded")
+	case <-time.After(10 * time.Millisecond):
+	}
+	(<-pending)(nil)
+	assert.Nil(t, <-results)
+	<-started
+	(<-pending)(errors.New("E_BAD_TOPIC"))
+	assert.NotNil(t, <-results)
+}
@@ -0,0 +1,188 @@
+package rpc
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Batching configures coalescing of concurrent requests to the same topic
+// into one nsq MultiPublish. Publisher should implement MultiPublisher.
+type Batching struct {
+	// MaxSize maximal number of requests in one MultiPublish, batch is
+	// published as soon as it is full.
+	MaxSize int
+	// MaxDelay how long first request in batch waits for others, default 1ms.
+	MaxDelay time.Duration
+}
+
+func (b *Batching) maxDelay() time.Duration {
+	if b.MaxDelay <= 0 {
+		return time.Millisecond
+	}
+	return b.MaxDelay
+}
+
+// SetBatching enables publishing of concurrent requests in batches.
+// Nil (or MaxSize < 2) disables batching.
+// Must be called before first request.
+func (c *Client) SetBatching(b *Batching) {
+	if b != nil && b.MaxSize < 2 {
+		b = nil
+	}
+	c.batching = b
+}
+
+// publish publishes request body to topic, in batch when batching is enabled.
+func (c *Client) publish(topic string, body []byte) error {
+	if c.batching == nil {
+		return c.publisher.Publish(topic, body)
+	}
+	return c.batcher(topic).publish(body)
+}
+
+func (c *Client) batcher(topic string) *batcher {
+	c.Lock()
+	defer c.Unlock()
+	b, ok := c.batchers[topic]
+	if !ok {
+		b = &batcher{
+			topic:    topic,
+			maxSize:  c.batching.MaxSize,
+			maxDelay: c.batching.maxDelay(),
+			multiPublish: func(topic string, bodies [][]byte) error {
+				return multiPublish(c.publisher, topic, bodies)
+			},
+		}
+		c.batchers[topic] = b
+	}
+	return b
+}
+
+// batcher collects bodies for one topic and publishes them together.
+type batcher struct {
+	topic        string
+	maxSize      int
+	maxDelay     time.Duration
+	multiPublish func(topic string, bodies [][]byte) error
+	bodies       [][]byte
+	waiters      []chan error
+	timer        *time.Timer
+	sync.Mutex
+}
+
+// publish adds body to the batch and waits until batch is published.
+func (b *batcher) publish(body []byte) error {
+	ch := make(chan error, 1)
+	b.Lock()
+	b.bodies = append(b.bodies, body)
+	b.waiters = append(b.waiters, ch)
+	if len(b.bodies) >= b.maxSize {
+		bodies, waiters := b.take()
+		b.Unlock()
+		b.flush(bodies, waiters)
+	} else {
+		if b.timer == nil {
+			b.timer = time.AfterFunc(b.maxDelay, b.flushPending)
+		}
+		b.Unlock()
+	}
+	return <-ch
+}
+
+// take removes collected bodies from batcher, must be called under lock.
+func (b *batcher) take() ([][]byte, []chan error) {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	bodies, waiters := b.bodies, b.waiters
+	b.bodies, b.waiters = nil, nil
+	return bodies, waiters
+}
+
+func (b *batcher) flushPending() {
+	b.Lock()
+	bodies, waiters := b.take()
+	b.Unlock()
+	b.flush(bodies, waiters)
+}
+
+func (b *batcher) flush(bodies [][]byte, waiters []chan error) {
+	if len(bodies) == 0 {
+		return
+	}
+	err := b.multiPublish(b.topic, bodies)
+	for _, w := range waiters {
+		w <- err
+	}
+}
+
+// BatchCall one request of CallBatch.
+type BatchCall struct {
+	Method string
+	Body   []byte
+}
+
+// BatchReply reply to one request of CallBatch, same as return values of
+// CallTopic.
+type BatchReply struct {
+	Body   []byte
+	AppErr string
+	Err    error
+}
+
+// CallBatch publishes all requests to reqTopic in one MultiPublish and waits
+// for their replies. Returns reply for each call, in order of calls.
+// Interceptors and retry policy are not used for batch calls.
+func (c *Client) CallBatch(ctx context.Context, reqTopic string, calls []BatchCall) (replies []BatchReply) {
+	if len(calls) == 0 {
+		return nil
+	}
+	ctx, span := c.tracer.StartSpan(ctx, SpanClient, reqTopic, "batch")
+	start := time.Now()
+	defer func() {
+		d := time.Since(start)
+		for i, r := range replies {
+			c.metrics.ClientCall(reqTopic, calls[i].Method, d, callError(r.AppErr, r.Err))
+		}
+	}()
+	replies = make([]BatchReply, len(calls))
+	ids := make([]uint64, len(calls))
+	chans := make([]chan *Envelope, len(calls))
+	bodies := make([][]byte, len(calls))
+	for i, call := range calls {
+		eReq := c.request(ctx, call.Method, call.Body)
+		// each call of the batch is different request
+		eReq.RequestID = newRequestID()
+		ids[i] = eReq.CorrelationID
+		chans[i] = make(chan *Envelope, 1)
+		c.add(ids[i], chans[i])
+		bodies[i] = eReq.Encode()
+	}
+	c.metrics.ClientPending(reqTopic, len(calls))
+	defer c.metrics.ClientPending(reqTopic, -len(calls))
+	if err := multiPublish(c.publisher, reqTopic, bodies); err != nil {
+		err = &PublishError{Err: err}
+		for i := range calls {
+			c.get(ids[i]) // unsubscribe
+			replies[i].Err = err
+		}
+		span.End(err)
+		return replies
+	}
+	for i := range calls {
+		select {
+		case rsp := <-chans[i]:
+			replies[i].Body, replies[i].AppErr = rsp.Body, rsp.Error
+			if rsp.AppError != nil {
+				replies[i].Err = rsp.AppError
+			}
+		case <-ctx.Done():
+			c.timeout(ids[i])
+			replies[i].Err = ctx.Err()
+		}
+	}
+	span.End(ctx.Err())
+	return replies
+}
@@ -0,0 +1,50 @@
+package rpc
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatcher(t *testing.T) {
+	var mu sync.Mutex
+	var batches [][][]byte
+	b := &batcher{
+		topic:    "service.req",
+		maxSize:  3,
+		maxDelay: 10 * time.Millisecond,
+		multiPublish: func(topic string, bodies [][]byte) error {
+			mu.Lock()
+			defer mu.Unlock()
+			batches = append(batches, bodies)
+			return nil
+		},
+	}
+	publish := func(n int) {
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				assert.Nil(t, b.publish([]byte(fmt.Sprint(i))))
+			}(i)
+		}
+		wg.Wait()
+	}
+	// full batch is published at once
+	publish(3)
+	assert.Len(t, batches, 1)
+	assert.Len(t, batches[0], 3)
+	// partial batch after max delay
+	publish(2)
+	assert.Len(t, batches, 2)
+	assert.Len(t, batches[1], 2)
+
+	// error is returned to all requests in batch
+	b.multiPublish = func(topic string, bodies [][]byte) error { return errors.New("E_BAD_TOPIC") }
+	assert.NotNil(t, b.publish([]byte("x")))
+}
@@ -2,52 +2,145 @@ package rpc
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/binary"
 	"fmt"
 	"math"
-	"math/rand"
 	"sync"
 	"time"
 
+	"github.com/minus5/nsqm/log"
 	"github.com/nsqio/go-nsq"
 	"github.com/pkg/errors"
 )
 
 // Client rpc client side.
 type Client struct {
-	publisher   *nsq.Producer
-	reqTopic    string
-	rspTopic    string
-	msgNo       uint32
-	subscribers map[uint32]chan *Envelope
+	publisher    Publisher
+	reqTopic     string
+	rspTopic     string
+	format       Format
+	tracer       Tracer
+	metrics      Metrics
+	logger       log.Logger
+	retry        *RetryPolicy
+	batching     *Batching
+	batchers     map[string]*batcher
+	async        *asyncPublisher
+	invoker      Invoker
+	interceptors []ClientInterceptor
+	msgNo        uint64
+	subscribers  map[uint64]chan *Envelope
+	timedOut     map[uint64]time.Time // when subscriber timed out
+	lastSweep    time.Time
+	now          func() time.Time
+	streams      map[uint64]*Stream
+	gatherers    map[uint64]*gatherer
 	sync.Mutex
 }
 
 // NewClient creates new rpc client.
 // publisher will be used for sending request on reqTopic.
 // rspTopic will be send in each message envelope, server will reply on that topic.
-func NewClient(publisher *nsq.Producer, reqTopic, rspTopic string) *Client {
-	rand.Seed(time.Now().UnixNano())
-	return &Client{
+func NewClient(publisher Publisher, reqTopic, rspTopic string) *Client {
+	c := &Client{
 		publisher:   publisher,
 		reqTopic:    reqTopic,
 		rspTopic:    rspTopic,
-		msgNo:       rand.Uint32(),
-		subscribers: make(map[uint32]chan *Envelope),
+		tracer:      noopTracer{},
+		metrics:     noopMetrics{},
+		logger:      log.Nop,
+		msgNo:       randomUint64(),
+		subscribers: make(map[uint64]chan *Envelope),
+		timedOut:    make(map[uint64]time.Time),
+		now:         time.Now,
+		streams:     make(map[uint64]*Stream),
+		gatherers:   make(map[uint64]*gatherer),
+		batchers:    make(map[string]*batcher),
 	}
+	c.invoker = c.call
+	return c
+}
+
+// SetRetryPolicy sets policy for retrying failed calls.
+// Nil disables retries.
+// Must be called before first request.
+func (c *Client) SetRetryPolicy(p *RetryPolicy) {
+	c.retry = p
+}
+
+// Use adds interceptors to the client. Interceptors are called in order in
+// which they are added, for each CallTopic.
+// Must be called before first request.
+func (c *Client) Use(interceptors ...ClientInterceptor) {
+	c.interceptors = append(c.interceptors, interceptors...)
+	c.invoker = chainClient(c.call, c.interceptors)
+}
+
+// SetLogger sets logger for reporting dropped and late replies.
+func (c *Client) SetLogger(l log.Logger) {
+	if l == nil {
+		l = log.Nop
+	}
+	c.logger = l
+}
+
+// SetFormat sets wire format of the request envelopes.
+// Server replies in the format of the request.
+// Must be called before first request.
+func (c *Client) SetFormat(f Format) {
+	c.format = f
+}
+
+// SetTracer sets tracer for client calls.
+// Without tracer client only propagates trace context found in the call context.
+// Must be called before first request.
+func (c *Client) SetTracer(t Tracer) {
+	if t == nil {
+		t = noopTracer{}
+	}
+	c.tracer = t
 }
 
 // HandleMessage accepts incoming server reponses.
 func (c *Client) HandleMessage(m *nsq.Message) error {
+	return c.Handle(m.Body, m)
+}
+
+// Handle accepts incoming server reponse with body, received in message m.
+// Same as nsq.Handler, m should be finished when Handle returns nil and
+// requeued on error, unless auto response is disabled by Handle.
+func (c *Client) Handle(body []byte, m Message) error {
 	fin := func() {
 		m.DisableAutoResponse()
 		m.Finish()
 	}
 	// unpack message
-	rsp, err := Decode(m.Body)
+	rsp, err := Decode(body)
 	if err != nil {
+		c.logger.Log(log.LevelError, "reply dropped", "topic", c.rspTopic, "error", err)
 		fin()
 		return errors.Wrap(err, "envelope unpack failed")
 	}
+	// reply must be for this client
+	if rsp.ReplyTo != "" && rsp.ReplyTo != c.rspTopic {
+		c.logger.Log(log.LevelWarn, "reply for other client dropped", "topic", c.rspTopic, "reply_to", rsp.ReplyTo, "correlation_id", rsp.CorrelationID)
+		fin()
+		return fmt.Errorf("reply for %s received on %s", rsp.ReplyTo, c.rspTopic)
+	}
+	// stream replies
+	if s, found := c.getStream(rsp.CorrelationID); found {
+		s.push(rsp)
+		return nil
+	}
+	// replies for gather request
+	if g, found := c.getGatherer(rsp.CorrelationID); found {
+		select {
+		case g.ch <- rsp:
+		case <-g.done:
+		}
+		return nil
+	}
 	// find subscriber waiting for response
 	if s, found := c.get(rsp.CorrelationID); found {
 		if s != nil {
@@ -55,8 +148,14 @@ func (c *Client) HandleMessage(m *nsq.Message) error {
 		}
 		// when s == nil, means that request timed out, nobody is waiting for response
 		// nothing to do in that case
+		if s == nil {
+			c.metrics.LateReply(c.rspTopic)
+			c.logger.Log(log.LevelDebug, "late reply", "topic", c.rspTopic, "correlation_id", rsp.CorrelationID)
+		}
 		return nil
 	}
+	c.metrics.LateReply(c.rspTopic)
+	c.logger.Log(log.LevelWarn, "subscriber not found", "topic", c.rspTopic, "correlation_id", rsp.CorrelationID)
 	fin()
 	return fmt.Errorf("subscriber not found for %d", rsp.CorrelationID)
 }
@@ -65,67 +164,317 @@ func (c *Client) Call(ctx context.Context, typ string, req []byte) ([]byte, stri
 	return c.CallTopic(ctx, c.reqTopic, typ, req)
 }
 
-// Call entry point for request from application.
-func (c *Client) CallTopic(ctx context.Context, reqTopic, typ string, req []byte) ([]byte, string, error) {
-	// craete envelope
-	correlationID := c.correlationID()
-	eReq := &Envelope{
-		Method:        typ,
-		ReplyTo:       c.rspTopic,
-		CorrelationID: correlationID,
-		Body:          req,
+// CallTopic entry point for request from application.
+// Returns reply body, application error text and error.
+// Error is transport error, context error or *Error when application on
+// the server side returned structured error.
+// Structured error is returned as err together with its text in appErr,
+// callers which treat every non nil err as transport failure should check
+// errors.As with *Error first. Plain application errors are still
+// returned only in appErr with nil err.
+func (c *Client) CallTopic(ctx context.Context, reqTopic, typ string, req []byte) (rspBody []byte, appErr string, err error) {
+	ctx, span := c.tracer.StartSpan(ctx, SpanClient, reqTopic, typ)
+	start := time.Now()
+	defer func() {
+		span.End(err)
+		c.metrics.ClientCall(reqTopic, typ, time.Since(start), callError(appErr, err))
+	}()
+	return c.invoker(ctx, reqTopic, typ, req)
+}
+
+// CallDeferredTopic sends request to reqTopic which nsqd delivers to the
+// server after delay (nsq DPUB) and waits for the reply. Unlike
+// SendDeferredTopic deadline of ctx is not moved, it should leave room for
+// the delay since reply can't arrive before it. RetryPolicy.AttemptTimeout
+// is extended by delay. Delay <= 0 sends request immediately, same as
+// CallTopic.
+// Returns PublishError with ErrDeferredNotSupported if publisher doesn't
+// implement DeferredPublisher.
+func (c *Client) CallDeferredTopic(ctx context.Context, reqTopic, typ string, delay time.Duration, req []byte) ([]byte, string, error) {
+	return c.CallTopic(withDelay(ctx, delay), reqTopic, typ, req)
+}
+
+// call sends request and waits for reply, end of interceptors chain.
+// Retries idempotent methods according to retry policy.
+func (c *Client) call(ctx context.Context, reqTopic, typ string, req []byte) ([]byte, string, error) {
+	// same request id for all attempts
+	if outgoingRequestID(ctx) == "" {
+		ctx = WithRequestID(ctx, newRequestID())
 	}
-	if d, ok := ctx.Deadline(); ok {
-		eReq.ExpiresAt = d.Unix()
+	attempts := c.retry.attempts(typ)
+	for n := 1; ; n++ {
+		rsp, appErr, err := c.attempt(ctx, reqTopic, typ, req)
+		if err == nil || n >= attempts || ctx.Err() != nil || !c.retry.retryable(err) {
+			return rsp, appErr, err
+		}
+		if serr := sleep(ctx, c.retry.backoff(n+1)); serr != nil {
+			return nil, "", err
+		}
 	}
-	rspCh := make(chan *Envelope)
+}
+
+// attempt sends request once and waits for reply.
+func (c *Client) attempt(ctx context.Context, reqTopic, typ string, req []byte) ([]byte, string, error) {
+	parent := ctx
+	delay := outgoingDelay(ctx)
+	if c.retry != nil && c.retry.AttemptTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.retry.AttemptTimeout+delay)
+		defer cancel()
+	}
+	eReq := c.request(ctx, typ, req)
+	correlationID := eReq.CorrelationID
+	rspCh := make(chan *Envelope, 1)
 	// subscriebe for response on that correlationID
 	c.add(correlationID, rspCh)
+	c.metrics.ClientPending(reqTopic, 1)
+	defer c.metrics.ClientPending(reqTopic, -1)
 	// send request to the server
-	if err := c.publisher.Publish(reqTopic, eReq.Encode()); err != nil {
-		return nil, "", errors.Wrap(err, "nsq publish failed")
+	var pubCh <-chan error
+	var err error
+	if delay > 0 {
+		err = deferredPublish(c.publisher, reqTopic, delay, eReq.Encode())
+	} else {
+		pubCh, err = c.startPublish(reqTopic, eReq.Encode())
+	}
+	if err != nil {
+		c.get(correlationID) // unsubscribe
+		return nil, "", &PublishError{Err: err}
 	}
 	// wiat for response or context timeout/cancelation
-	select {
-	case rsp := <-rspCh:
-		return rsp.Body, rsp.Error, nil
-	case <-ctx.Done():
-		c.timeout(correlationID)
-		return nil, "", ctx.Err()
+	for {
+		select {
+		case err := <-pubCh:
+			// result of async publish
+			if err != nil {
+				c.get(correlationID) // unsubscribe
+				return nil, "", &PublishError{Err: err}
+			}
+			pubCh = nil
+		case rsp := <-rspCh:
+			setReplyHeaders(ctx, rsp.Headers)
+			if rsp.AppError != nil {
+				return rsp.Body, rsp.Error, rsp.AppError
+			}
+			return rsp.Body, rsp.Error, nil
+		case <-ctx.Done():
+			c.timeout(correlationID)
+			if parent.Err() == nil {
+				return nil, "", ErrAttemptTimeout
+			}
+			return nil, "", parent.Err()
+		}
+	}
+}
+
+// callError returns err or application error from the reply text, when
+// server didn't send structured error.
+func callError(appErr string, err error) error {
+	if err == nil && appErr != "" {
+		return &Error{Message: appErr}
 	}
+	return err
 }
 
-func (c *Client) correlationID() uint32 {
+// request creates request envelope with new correlationID and options from ctx.
+// Request id is taken from ctx (WithRequestID) or generated.
+func (c *Client) request(ctx context.Context, typ string, req []byte) *Envelope {
+	requestID := outgoingRequestID(ctx)
+	if requestID == "" {
+		requestID = newRequestID()
+	}
+	e := &Envelope{
+		Method:        typ,
+		ReplyTo:       c.rspTopic,
+		CorrelationID: c.correlationID(),
+		RequestID:     requestID,
+		Headers:       outgoingHeaders(ctx),
+		Codec:         outgoingCodec(ctx),
+		Body:          req,
+		Format:        c.format,
+	}
+	if d, ok := ctx.Deadline(); ok {
+		e.SetDeadline(d)
+	}
+	e.setTraceContext(c.tracer.Inject(ctx))
+	return e
+}
+
+// SendTopic sends one-way request to reqTopic, server doesn't reply.
+func (c *Client) SendTopic(ctx context.Context, reqTopic, typ string, req []byte) error {
+	return c.send(ctx, reqTopic, typ, 0, req)
+}
+
+// SendDeferredTopic sends one-way request to reqTopic which nsqd delivers to
+// the server after delay (nsq DPUB, delay is limited by nsqd
+// max-req-timeout). Deadline of ctx is moved by delay, so request expires
+// relative to the time of delivery.
+// Returns ErrDeferredNotSupported if publisher doesn't implement
+// DeferredPublisher.
+func (c *Client) SendDeferredTopic(ctx context.Context, reqTopic, typ string, delay time.Duration, req []byte) error {
+	return c.send(ctx, reqTopic, typ, delay, req)
+}
+
+func (c *Client) send(ctx context.Context, reqTopic, typ string, delay time.Duration, req []byte) (err error) {
+	ctx, span := c.tracer.StartSpan(ctx, SpanProducer, reqTopic, typ)
+	defer func() { span.End(err) }()
+	eReq := c.request(ctx, typ, req)
+	eReq.ReplyTo = ""
+	if delay <= 0 {
+		err = c.publish(reqTopic, eReq.Encode())
+	} else {
+		if d, ok := ctx.Deadline(); ok {
+			eReq.SetDeadline(d.Add(delay))
+		}
+		err = deferredPublish(c.publisher, reqTopic, delay, eReq.Encode())
+	}
+	if err != nil {
+		return &PublishError{Err: err}
+	}
+	return nil
+}
+
+// DefaultGatherTimeout how long GatherTopic collects replies when ctx has no deadline.
+var DefaultGatherTimeout = 10 * time.Second
+
+// GatherTopic sends request to reqTopic and collects replies from all
+// servers which receive it (each channel of the topic) until ctx is done,
+// or DefaultGatherTimeout when ctx has no deadline.
+// Returned replies have Body, Error and AppError set.
+func (c *Client) GatherTopic(ctx context.Context, reqTopic, typ string, req []byte) (rsps []*Envelope, err error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultGatherTimeout)
+		defer cancel()
+	}
+	ctx, span := c.tracer.StartSpan(ctx, SpanClient, reqTopic, typ)
+	defer func() { span.End(err) }()
+	eReq := c.request(ctx, typ, req)
+	g := &gatherer{ch: make(chan *Envelope), done: make(chan struct{})}
+	c.addGatherer(eReq.CorrelationID, g)
+	defer c.removeGatherer(eReq.CorrelationID)
+	if err := c.publish(reqTopic, eReq.Encode()); err != nil {
+		return nil, &PublishError{Err: err}
+	}
+	for {
+		select {
+		case rsp := <-g.ch:
+			rsps = append(rsps, rsp)
+		case <-ctx.Done():
+			return rsps, nil
+		}
+	}
+}
+
+// gatherer receives multiple replies for one request.
+type gatherer struct {
+	ch   chan *Envelope
+	done chan struct{}
+}
+
+func (c *Client) addGatherer(id uint64, g *gatherer) {
 	c.Lock()
 	defer c.Unlock()
-	if c.msgNo == math.MaxUint32 {
-		c.msgNo = 0
-	} else {
-		c.msgNo++
+	c.gatherers[id] = g
+}
+
+func (c *Client) getGatherer(id uint64) (*gatherer, bool) {
+	c.Lock()
+	defer c.Unlock()
+	g, ok := c.gatherers[id]
+	return g, ok
+}
+
+// removeGatherer stops gathering. Replies which arrive later are handled
+// as late replies.
+func (c *Client) removeGatherer(id uint64) {
+	c.Lock()
+	defer c.Unlock()
+	close(c.gatherers[id].done)
+	delete(c.gatherers, id)
+}
+
+// correlationID returns next correlationID.
+// Starts from random number so replies for different clients (or restarted
+// client) don't collide.
+// In json format ids are kept in 32 bits, servers older than binary format
+// decode correlationID into uint32.
+func (c *Client) correlationID() uint64 {
+	c.Lock()
+	defer c.Unlock()
+	c.msgNo++
+	if c.format == FormatJSON {
+		c.msgNo &= math.MaxUint32
+		if c.msgNo == 0 {
+			c.msgNo++
+		}
 	}
 	return c.msgNo
 }
 
-func (c *Client) add(id uint32, ch chan *Envelope) {
+func randomUint64() uint64 {
+	var buf [8]byte
+	rand.Read(buf[:])
+	return binary.BigEndian.Uint64(buf[:])
+}
+
+// lateReplyWindow how long timed out request is remembered, so its late
+// reply is recognized. Older ones are removed by sweep.
+var lateReplyWindow = time.Minute
+
+func (c *Client) add(id uint64, ch chan *Envelope) {
 	c.Lock()
 	defer c.Unlock()
+	c.sweep()
 	c.subscribers[id] = ch
 }
 
-func (c *Client) get(id uint32) (chan *Envelope, bool) {
+func (c *Client) get(id uint64) (chan *Envelope, bool) {
 	c.Lock()
 	defer c.Unlock()
 	ch, ok := c.subscribers[id]
 	if ok {
 		delete(c.subscribers, id)
+		delete(c.timedOut, id)
 	}
 	return ch, ok
 }
 
-func (c *Client) timeout(id uint32) {
+// sweep removes subscribers timed out more than lateReplyWindow ago,
+// at most once per window. Replies which never arrive would leak them.
+// Must be called with lock held.
+func (c *Client) sweep() {
+	now := c.now()
+	if now.Sub(c.lastSweep) < lateReplyWindow {
+		return
+	}
+	c.lastSweep = now
+	for id, t := range c.timedOut {
+		if now.Sub(t) >= lateReplyWindow {
+			delete(c.timedOut, id)
+			delete(c.subscribers, id)
+		}
+	}
+}
+
+// Pending returns number of requests waiting for reply.
+func (c *Client) Pending() int {
+	c.Lock()
+	defer c.Unlock()
+	n := 0
+	for _, ch := range c.subscribers {
+		if ch != nil {
+			n++
+		}
+	}
+	return n
+}
+
+func (c *Client) timeout(id uint64) {
 	c.Lock()
 	defer c.Unlock()
 	if _, found := c.subscribers[id]; found {
 		c.subscribers[id] = nil
+		c.timedOut[id] = c.now()
 	}
 }
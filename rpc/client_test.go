@@ -0,0 +1,134 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientGathersReplies(t *testing.T) {
+	c := NewClient(nil, "service.req", "service.rsp")
+	g := &gatherer{ch: make(chan *Envelope), done: make(chan struct{})}
+	c.addGatherer(1, g)
+	go func() {
+		for _, body := range []string{"a", "b"} {
+			e := &Envelope{CorrelationID: 1, Body: []byte(body)}
+			c.HandleMessage(newMessage(&msgDelegate{}, e))
+		}
+	}()
+	assert.Equal(t, "a", string((<-g.ch).Body))
+	assert.Equal(t, "b", string((<-g.ch).Body))
+
+	// replies after gathering is done are not delivered
+	c.removeGatherer(1)
+	_, found := c.getGatherer(1)
+	assert.False(t, found)
+	assert.NotNil(t, c.HandleMessage(newMessage(&msgDelegate{}, &Envelope{CorrelationID: 1})))
+}
+
+func TestGatherDefaultTimeout(t *testing.T) {
+	defer func(d time.Duration) { DefaultGatherTimeout = d }(DefaultGatherTimeout)
+	DefaultGatherTimeout = 20 * time.Millisecond
+	var c *Client
+	p := publisherFunc(func(topic string, body []byte) error {
+		req, _ := Decode(body)
+		go func() {
+			rsp := req.Reply([]byte("a"), nil)
+			c.Handle(rsp.Encode(), &fakeMessage{})
+		}()
+		return nil
+	})
+	c = NewClient(p, "service.req", "service.rsp")
+	// ctx without deadline
+	rsps, err := c.GatherTopic(context.Background(), "service.req.broadcast", "Add", nil)
+	assert.Nil(t, err)
+	assert.Len(t, rsps, 1)
+	assert.Len(t, c.gatherers, 0)
+}
+
+// deferredPublisher records published and deferred requests.
+type deferredPublisher struct {
+	published []*Envelope
+	deferred  []*Envelope
+	delays    []time.Duration
+	onPublish func(e *Envelope)
+}
+
+func (p *deferredPublisher) Publish(topic string, body []byte) error {
+	e, _ := Decode(body)
+	p.published = append(p.published, e)
+	if p.onPublish != nil {
+		p.onPublish(e)
+	}
+	return nil
+}
+
+func (p *deferredPublisher) DeferredPublish(topic string, delay time.Duration, body []byte) error {
+	e, _ := Decode(body)
+	p.deferred = append(p.deferred, e)
+	p.delays = append(p.delays, delay)
+	if p.onPublish != nil {
+		p.onPublish(e)
+	}
+	return nil
+}
+
+func TestSendDeferred(t *testing.T) {
+	p := &deferredPublisher{}
+	c := NewClient(p, "service.req", "service.rsp")
+	deadline := time.Now().Add(time.Minute)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	// deadline is moved by delay
+	assert.Nil(t, c.SendDeferredTopic(ctx, "service.req", "Add", time.Hour, nil))
+	assert.Len(t, p.deferred, 1)
+	assert.Equal(t, []time.Duration{time.Hour}, p.delays)
+	d, ok := p.deferred[0].Deadline()
+	assert.True(t, ok)
+	assert.Equal(t, deadline.Add(time.Hour).Truncate(time.Millisecond), d.Truncate(time.Millisecond))
+	assert.Empty(t, p.deferred[0].ReplyTo)
+
+	// without delay request is published immediately
+	assert.Nil(t, c.SendDeferredTopic(ctx, "service.req", "Add", 0, nil))
+	assert.Nil(t, c.SendDeferredTopic(ctx, "service.req", "Add", -time.Second, nil))
+	assert.Len(t, p.deferred, 1)
+	assert.Len(t, p.published, 2)
+	d, _ = p.published[0].Deadline()
+	assert.Equal(t, deadline.Truncate(time.Millisecond), d.Truncate(time.Millisecond))
+}
+
+func TestCallDeferred(t *testing.T) {
+	p := &deferredPublisher{}
+	c := NewClient(p, "service.req", "service.rsp")
+	p.onPublish = func(req *Envelope) {
+		go c.Handle(req.Reply([]byte("ok"), nil).Encode(), &fakeMessage{})
+	}
+	deadline := time.Now().Add(time.Minute)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	rsp, _, err := c.CallDeferredTopic(ctx, "service.req", "Add", time.Second, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "ok", string(rsp))
+	assert.Len(t, p.deferred, 1)
+	assert.Equal(t, "service.rsp", p.deferred[0].ReplyTo)
+	// client waits until ctx deadline, it is not moved
+	d, _ := p.deferred[0].Deadline()
+	assert.Equal(t, deadline.Truncate(time.Millisecond), d.Truncate(time.Millisecond))
+
+	// without delay same as Call
+	rsp, _, err = c.CallDeferredTopic(ctx, "service.req", "Add", 0, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "ok", string(rsp))
+	assert.Len(t, p.deferred, 1)
+	assert.Len(t, p.published, 1)
+
+	// publisher without DeferredPublish
+	c = NewClient(publisherFunc(func(string, []byte) error { return nil }), "service.req", "service.rsp")
+	_, _, err = c.CallDeferredTopic(ctx, "service.req", "Add", time.Second, nil)
+	assert.True(t, errors.Is(err, ErrDeferredNotSupported))
+}
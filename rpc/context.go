@@ -0,0 +1,168 @@
+package rpc
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type contextKey int
+
+const (
+	codecKey contextKey = iota
+	headersKey
+	replyHeadersKey
+	requestKey
+	traceKey
+	requestIDKey
+	delayKey
+)
+
+// Headers request or reply metadata.
+type Headers map[string]string
+
+// request information about the incoming request, stored in the context
+// passed to the application on the server side.
+type request struct {
+	env          *Envelope
+	replyHeaders Headers
+	sync.Mutex
+}
+
+func withRequest(ctx context.Context, env *Envelope) (context.Context, *request) {
+	r := &request{env: env}
+	return context.WithValue(ctx, requestKey, r), r
+}
+
+func requestFromContext(ctx context.Context) *request {
+	r, _ := ctx.Value(requestKey).(*request)
+	return r
+}
+
+// WithCodec returns context which instructs client to mark request body as
+// encoded with codec name.
+// On the server side codec of the request is available through CodecFromContext.
+func WithCodec(ctx context.Context, name string) context.Context {
+	if name == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, codecKey, name)
+}
+
+func outgoingCodec(ctx context.Context) string {
+	name, _ := ctx.Value(codecKey).(string)
+	return name
+}
+
+// CodecFromContext returns codec name of the incoming request, empty if not set.
+func CodecFromContext(ctx context.Context) string {
+	if r := requestFromContext(ctx); r != nil {
+		return r.env.Codec
+	}
+	return ""
+}
+
+// WithHeaders returns context which instructs client to send headers with
+// the request. Headers are merged with headers already set in ctx.
+// On the server side headers are available through HeadersFromContext.
+func WithHeaders(ctx context.Context, h Headers) context.Context {
+	if len(h) == 0 {
+		return ctx
+	}
+	merged := make(Headers)
+	for k, v := range outgoingHeaders(ctx) {
+		merged[k] = v
+	}
+	for k, v := range h {
+		merged[k] = v
+	}
+	return context.WithValue(ctx, headersKey, merged)
+}
+
+func outgoingHeaders(ctx context.Context) Headers {
+	h, _ := ctx.Value(headersKey).(Headers)
+	return h
+}
+
+// HeadersFromContext returns headers of the incoming request.
+// Returned map must not be modified.
+func HeadersFromContext(ctx context.Context) Headers {
+	if r := requestFromContext(ctx); r != nil {
+		return r.env.Headers
+	}
+	return nil
+}
+
+// SetReplyHeader sets header which server will send with the reply.
+// Noop if ctx is not server side request context.
+func SetReplyHeader(ctx context.Context, key, value string) {
+	r := requestFromContext(ctx)
+	if r == nil {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	if r.replyHeaders == nil {
+		r.replyHeaders = make(Headers)
+	}
+	r.replyHeaders[key] = value
+}
+
+func (r *request) getReplyHeaders() Headers {
+	r.Lock()
+	defer r.Unlock()
+	return r.replyHeaders
+}
+
+// WithReplyHeaders returns context which instructs client to copy headers
+// received in the reply into h.
+func WithReplyHeaders(ctx context.Context, h Headers) context.Context {
+	return context.WithValue(ctx, replyHeadersKey, h)
+}
+
+func setReplyHeaders(ctx context.Context, rsp Headers) {
+	h, _ := ctx.Value(replyHeadersKey).(Headers)
+	if h == nil {
+		return
+	}
+	for k, v := range rsp {
+		h[k] = v
+	}
+}
+
+// WithRequestID returns context which instructs client to send request with
+// id. Server with DedupStore processes requests with the same id only once.
+// When not set client generates random id for each call, which is the same
+// for all retry attempts. Used for all requests (one-way, deferred,
+// broadcast, gather, stream) except CallBatch, where each call gets its
+// own id.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+func outgoingRequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// RequestIDFromContext returns id of the incoming request.
+func RequestIDFromContext(ctx context.Context) string {
+	if r := requestFromContext(ctx); r != nil {
+		return r.env.RequestID
+	}
+	return ""
+}
+
+// withDelay returns context which instructs client to publish request
+// deferred by delay.
+func withDelay(ctx context.Context, delay time.Duration) context.Context {
+	if delay <= 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, delayKey, delay)
+}
+
+func outgoingDelay(ctx context.Context) time.Duration {
+	d, _ := ctx.Value(delayKey).(time.Duration)
+	return d
+}
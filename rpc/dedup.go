@@ -0,0 +1,115 @@
+package rpc
+
+import (
+	"container/list"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// DedupStore keeps replies of processed requests, by request id, so server
+// can replay reply to the repeated request instead of processing it again.
+type DedupStore interface {
+	// Begin marks request as in progress and returns ok.
+	// When request is already seen returns false and reply of the processed
+	// request, or nil reply if request is still in progress.
+	Begin(requestID string) (reply *Envelope, ok bool)
+	// Done stores reply of the processed request.
+	Done(requestID string, reply *Envelope)
+	// Abort removes in progress mark, request will be processed again.
+	Abort(requestID string)
+}
+
+// MemoryDedupStore in memory DedupStore.
+// Keeps up to size requests, each for ttl, least recently used are evicted first.
+type MemoryDedupStore struct {
+	size  int
+	ttl   time.Duration
+	items map[string]*list.Element
+	lru   *list.List
+	now   func() time.Time
+	sync.Mutex
+}
+
+type dedupItem struct {
+	id        string
+	reply     *Envelope
+	expiresAt time.Time
+}
+
+// Defaults of MemoryDedupStore used for non positive size or ttl.
+var (
+	DefaultDedupSize = 10000
+	DefaultDedupTTL  = 10 * time.Minute
+)
+
+// NewMemoryDedupStore creates in memory store for size requests kept for ttl.
+// Non positive size or ttl is replaced with DefaultDedupSize or DefaultDedupTTL.
+func NewMemoryDedupStore(size int, ttl time.Duration) *MemoryDedupStore {
+	if size <= 0 {
+		size = DefaultDedupSize
+	}
+	if ttl <= 0 {
+		ttl = DefaultDedupTTL
+	}
+	return &MemoryDedupStore{
+		size:  size,
+		ttl:   ttl,
+		items: make(map[string]*list.Element),
+		lru:   list.New(),
+		now:   time.Now,
+	}
+}
+
+// Begin implements DedupStore.
+func (s *MemoryDedupStore) Begin(requestID string) (*Envelope, bool) {
+	s.Lock()
+	defer s.Unlock()
+	now := s.now()
+	if e, ok := s.items[requestID]; ok {
+		it := e.Value.(*dedupItem)
+		if now.Before(it.expiresAt) {
+			s.lru.MoveToFront(e)
+			return it.reply, false
+		}
+		s.remove(e)
+	}
+	s.items[requestID] = s.lru.PushFront(&dedupItem{id: requestID, expiresAt: now.Add(s.ttl)})
+	for s.lru.Len() > s.size {
+		s.remove(s.lru.Back())
+	}
+	return nil, true
+}
+
+// Done implements DedupStore.
+func (s *MemoryDedupStore) Done(requestID string, reply *Envelope) {
+	s.Lock()
+	defer s.Unlock()
+	if e, ok := s.items[requestID]; ok {
+		it := e.Value.(*dedupItem)
+		it.reply = reply
+		it.expiresAt = s.now().Add(s.ttl)
+	}
+}
+
+// Abort implements DedupStore.
+func (s *MemoryDedupStore) Abort(requestID string) {
+	s.Lock()
+	defer s.Unlock()
+	if e, ok := s.items[requestID]; ok {
+		s.remove(e)
+	}
+}
+
+func (s *MemoryDedupStore) remove(e *list.Element) {
+	s.lru.Remove(e)
+	delete(s.items, e.Value.(*dedupItem).id)
+}
+
+// newRequestID creates random request id.
+func newRequestID() string {
+	var buf [16]byte
+	rand.Read(buf[:])
+	return hex.EncodeToString(buf[:])
+}
@@ -0,0 +1,160 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryDedupStore(t *testing.T) {
+	now := time.Now()
+	s := NewMemoryDedupStore(2, time.Minute)
+	s.now = func() time.Time { return now }
+
+	rsp, ok := s.Begin("a")
+	assert.True(t, ok)
+	assert.Nil(t, rsp)
+
+	// in progress
+	rsp, ok = s.Begin("a")
+	assert.False(t, ok)
+	assert.Nil(t, rsp)
+
+	// processed
+	s.Done("a", &Envelope{Body: []byte("5")})
+	rsp, ok = s.Begin("a")
+	assert.False(t, ok)
+	assert.Equal(t, []byte("5"), rsp.Body)
+
+	// aborted request can be processed again
+	_, ok = s.Begin("b")
+	assert.True(t, ok)
+	s.Abort("b")
+	_, ok = s.Begin("b")
+	assert.True(t, ok)
+
+	// least recently used is evicted
+	_, ok = s.Begin("c")
+	assert.True(t, ok)
+	_, ok = s.Begin("b")
+	assert.False(t, ok)
+	_, ok = s.Begin("a")
+	assert.True(t, ok)
+
+	// expired
+	now = now.Add(2 * time.Minute)
+	_, ok = s.Begin("c")
+	assert.True(t, ok)
+}
+
+func TestMemoryDedupStoreDefaults(t *testing.T) {
+	s := NewMemoryDedupStore(0, 0)
+	assert.Equal(t, DefaultDedupSize, s.size)
+	assert.Equal(t, DefaultDedupTTL, s.ttl)
+	_, ok := s.Begin("a")
+	assert.True(t, ok)
+	_, ok = s.Begin("a")
+	assert.False(t, ok)
+}
+
+func TestServerDedup(t *testing.T) {
+	calls := 0
+	app := appServerFunc(func(ctx context.Context, method string, req []byte) ([]byte, error) {
+		calls++
+		if string(req) == "postpone" {
+			return nil, context.Canceled
+		}
+		return []byte(fmt.Sprintf("reply %d", calls)), nil
+	})
+	var replies []*Envelope
+	p := publisherFunc(func(topic string, body []byte) error {
+		e, _ := Decode(body)
+		replies = append(replies, e)
+		return nil
+	})
+	store := NewMemoryDedupStore(10, time.Minute)
+	s := NewServer(context.Background(), app, p)
+	s.SetDedupStore(store)
+	handle := func(id string, correlationID uint64, body string) *fakeMessage {
+		m := &fakeMessage{}
+		req := &Envelope{Method: "Add", ReplyTo: "service.rsp", RequestID: id, CorrelationID: correlationID, Body: []byte(body)}
+		assert.Nil(t, s.Handle(req.Encode(), m))
+		return m
+	}
+
+	// processed once, repeated request gets replayed reply
+	handle("r1", 1, "")
+	handle("r1", 2, "")
+	assert.Equal(t, 1, calls)
+	assert.Len(t, replies, 2)
+	assert.Equal(t, "reply 1", string(replies[1].Body))
+	assert.Equal(t, uint64(2), replies[1].CorrelationID)
+
+	// in progress request is requeued without calling application
+	store.Begin("r2")
+	m := handle("r2", 3, "")
+	assert.Equal(t, 1, m.requeued)
+	assert.Equal(t, 1, calls)
+
+	// requeued request is aborted, so it is processed again
+	m = handle("r3", 4, "postpone")
+	assert.Equal(t, 1, m.requeued)
+	handle("r3", 5, "")
+	assert.Equal(t, 3, calls)
+	assert.Equal(t, "reply 3", string(replies[2].Body))
+}
+
+func TestServerReplayToOtherClient(t *testing.T) {
+	app := appServerFunc(func(ctx context.Context, method string, req []byte) ([]byte, error) {
+		return []byte("ok"), nil
+	})
+	var topics []string
+	var replies [][]byte
+	p := publisherFunc(func(topic string, body []byte) error {
+		topics = append(topics, topic)
+		replies = append(replies, body)
+		return nil
+	})
+	s := NewServer(context.Background(), app, p)
+	s.SetDedupStore(NewMemoryDedupStore(10, time.Minute))
+	for i, replyTo := range []string{"a.rsp", "b.rsp"} {
+		req := &Envelope{Method: "Add", ReplyTo: replyTo, RequestID: "r1", CorrelationID: uint64(i + 1)}
+		assert.Nil(t, s.Handle(req.Encode(), &fakeMessage{}))
+	}
+	assert.Equal(t, []string{"a.rsp", "b.rsp"}, topics)
+
+	// replay is accepted by the client which sent repeated request
+	c := NewClient(p, "service.req", "b.rsp")
+	ch := make(chan *Envelope, 1)
+	c.add(2, ch)
+	assert.Nil(t, c.Handle(replies[1], &fakeMessage{}))
+	rsp := <-ch
+	assert.Equal(t, "ok", string(rsp.Body))
+}
+
+func TestSendWithRequestIDDeduplicated(t *testing.T) {
+	calls := 0
+	app := appServerFunc(func(ctx context.Context, method string, req []byte) ([]byte, error) {
+		calls++
+		return nil, nil
+	})
+	s := NewServer(context.Background(), app, publisherFunc(func(string, []byte) error { return nil }))
+	s.SetDedupStore(NewMemoryDedupStore(10, time.Minute))
+	// client publishes one-way requests straight to the server
+	c := NewClient(publisherFunc(func(topic string, body []byte) error {
+		return s.Handle(body, &fakeMessage{})
+	}), "service.req", "service.rsp")
+
+	ctx := WithRequestID(context.Background(), "reminder-1")
+	assert.Nil(t, c.SendTopic(ctx, "service.req", "Remind", nil))
+	assert.Nil(t, c.SendTopic(ctx, "service.req", "Remind", nil))
+	assert.Equal(t, 1, calls)
+
+	// without request id each send gets its own
+	assert.Nil(t, c.SendTopic(context.Background(), "service.req", "Remind", nil))
+	assert.Nil(t, c.SendTopic(context.Background(), "service.req", "Remind", nil))
+	assert.Equal(t, 3, calls)
+}
@@ -0,0 +1,101 @@
+package rpc
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// DrainStats counts requests completed after server started draining.
+type DrainStats struct {
+	// Drained requests processed and replied to.
+	Drained uint64
+	// Requeued requests requeued because server context was canceled
+	// before they were processed.
+	Requeued uint64
+}
+
+// inFlight tracks requests which are being processed.
+type inFlight struct {
+	n        int
+	idle     chan struct{} // closed when n drops to zero, nil if nobody waits
+	draining bool
+	drained  uint64
+	requeued uint64
+	sync.Mutex
+}
+
+func (f *inFlight) add() {
+	f.Lock()
+	defer f.Unlock()
+	f.n++
+}
+
+// done marks request as completed, requeued or not.
+func (f *inFlight) done(requeued bool) {
+	f.Lock()
+	if f.draining {
+		if requeued {
+			atomic.AddUint64(&f.requeued, 1)
+		} else {
+			atomic.AddUint64(&f.drained, 1)
+		}
+	}
+	f.Unlock()
+	f.release()
+}
+
+// release decrements number of in flight requests (or async reply
+// publishes) without counting them in stats.
+func (f *inFlight) release() {
+	f.Lock()
+	defer f.Unlock()
+	f.n--
+	if f.n == 0 && f.idle != nil {
+		close(f.idle)
+		f.idle = nil
+	}
+}
+
+// wait returns channel closed when there are no requests in flight.
+func (f *inFlight) wait() <-chan struct{} {
+	f.Lock()
+	defer f.Unlock()
+	f.draining = true
+	if f.n == 0 {
+		ch := make(chan struct{})
+		close(ch)
+		return ch
+	}
+	if f.idle == nil {
+		f.idle = make(chan struct{})
+	}
+	return f.idle
+}
+
+// InFlight returns number of requests being processed.
+func (s *Server) InFlight() int {
+	s.inFlight.Lock()
+	defer s.inFlight.Unlock()
+	return s.inFlight.n
+}
+
+// Drain waits for in flight requests to complete and reply.
+// Returns ctx error if ctx is done before that. Drain doesn't stop receiving
+// new messages, stop consumer before calling Drain.
+func (s *Server) Drain(ctx context.Context) error {
+	select {
+	case <-s.inFlight.wait():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// DrainStats returns counters of requests completed after Drain was called.
+func (s *Server) DrainStats() DrainStats {
+	return DrainStats{
+		Drained:  atomic.LoadUint64(&s.inFlight.drained),
+		Requeued: atomic.LoadUint64(&s.inFlight.requeued),
+	}
+}
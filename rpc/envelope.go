@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"time"
 )
 
@@ -11,44 +13,176 @@ var (
 	headerSeparator = []byte{10} //new line
 )
 
+// Format of the envelope on the wire.
+type Format uint8
+
+const (
+	// FormatJSON json header, new line, body.
+	// Default format, understood by all versions of the library.
+	FormatJSON Format = iota
+	// FormatBinary compact binary header followed by body.
+	FormatBinary
+)
+
+// First byte of the encoded envelope identifies format.
+// Json header always starts with '{', binary starts with version byte.
+const (
+	jsonMagic      byte = '{'
+	binaryVersion1 byte = 0x81
+)
+
+// Binary header field tags.
+// Each field is encoded as tag, uvarint length, value.
+// Header ends with tagEnd, everything after that is body.
+// Decoder skips unknown tags so new fields can be added without breaking
+// older readers.
+const (
+	tagEnd byte = iota
+	tagMethod
+	tagReplyTo
+	tagCorrelationID
+	tagExpiresAt
+	tagError
+	tagCodec
+	tagAppError
+	tagHeaders
+	tagTraceParent
+	tagTraceState
+	tagRequestID
+	tagStream
+	tagSeq
+	tagEndOfStream
+)
+
+var (
+	// ErrUnknownFormat envelope first byte is not known format marker.
+	ErrUnknownFormat = errors.New("unknown envelope format")
+	errShortBuffer   = errors.New("envelope too short")
+)
+
 // Envelope arround message for request response communication over nsq.
 type Envelope struct {
 	// method to call on the server side
 	Method string `json:"m,omitempty"`
 	// nsq topic to send reply to
+	// in reply it is topic on which reply is sent, client uses it to check
+	// that reply belongs to him
 	ReplyTo string `json:"r,omitempty"`
 	// connection between request and response
-	CorrelationID uint32 `json:"c,omitempty"`
-	// unix timestamp when message expires, after that should be dropped
+	// 64 bit in binary format, kept in 32 bits by json clients for older servers
+	CorrelationID uint64 `json:"c,omitempty"`
+	// id of the request, same for all retries, used for deduplication
+	RequestID string `json:"i,omitempty"`
+	// unix timestamp in milliseconds when message expires, after that should
+	// be dropped; values in seconds, sent by older clients, are also accepted
 	ExpiresAt int64 `json:"x,omitempty"`
 	// applicationn error reponse, if server side failed and Body is missing
 	Error string `json:"e,omitempty"`
+	// structured application error, set when application returned *Error
+	AppError *Error `json:"a,omitempty"`
+	// request or reply metadata
+	Headers Headers `json:"h,omitempty"`
+	// W3C trace context
+	TraceParent string `json:"tp,omitempty"`
+	TraceState  string `json:"ts,omitempty"`
+	// name of the codec used for Body, empty for unknown
+	Codec string `json:"b,omitempty"`
+	// request expects stream of replies
+	Stream bool `json:"st,omitempty"`
+	// sequence number of the reply in stream, starting from 1
+	Seq uint64 `json:"q,omitempty"`
+	// last reply in stream, carries only error
+	EndOfStream bool `json:"eos,omitempty"`
 	// message body
 	Body []byte `json:"-"`
+	// wire format, set by Decode, used by Encode
+	Format Format `json:"-"`
 }
 
 // Reply creates reply Envelope from request Envelope.
+// Reply is encoded in the same format as request.
 func (m *Envelope) Reply(body []byte, err error) *Envelope {
 	e := &Envelope{
+		ReplyTo:       m.ReplyTo,
 		CorrelationID: m.CorrelationID,
 		Body:          body,
+		Format:        m.Format,
 	}
 	if err != nil {
 		e.Error = err.Error()
+		var appErr *Error
+		if errors.As(err, &appErr) {
+			e.AppError = appErr
+		}
 	}
 	return e
 }
 
-// Expired returns true if message expired.
-func (m *Envelope) Expired() bool {
+// TraceContext returns trace context carried in the envelope.
+func (m *Envelope) TraceContext() TraceContext {
+	return TraceContext{TraceParent: m.TraceParent, TraceState: m.TraceState}
+}
+
+func (m *Envelope) setTraceContext(tc TraceContext) {
+	if !tc.Valid() {
+		return
+	}
+	m.TraceParent = tc.TraceParent
+	m.TraceState = tc.TraceState
+}
+
+// maxExpiresAtSeconds largest ExpiresAt interpreted as seconds (year 33658).
+// Larger values are milliseconds.
+const maxExpiresAtSeconds = 1e12
+
+// SetDeadline sets message expiration to t, with millisecond precision.
+func (m *Envelope) SetDeadline(t time.Time) {
+	m.ExpiresAt = t.UnixNano() / int64(time.Millisecond)
+}
+
+// Deadline returns time when message expires, ok is false if message
+// doesn't expire.
+func (m *Envelope) Deadline() (t time.Time, ok bool) {
 	if m.ExpiresAt <= 0 {
-		return false
+		return time.Time{}, false
 	}
-	return time.Now().Unix() > m.ExpiresAt
+	if m.ExpiresAt < maxExpiresAtSeconds {
+		return time.Unix(m.ExpiresAt, 0), true
+	}
+	return time.Unix(0, m.ExpiresAt*int64(time.Millisecond)), true
+}
+
+// Expired returns true if message expired.
+func (m *Envelope) Expired() bool {
+	d, ok := m.Deadline()
+	return ok && time.Now().After(d)
 }
 
 // Decode decodes envelope from bytes.
+// Format is detected from the first byte so both json and binary envelopes
+// can be received on the same topic.
 func Decode(buf []byte) (*Envelope, error) {
+	if len(buf) == 0 {
+		return nil, errShortBuffer
+	}
+	switch buf[0] {
+	case jsonMagic:
+		return decodeJSON(buf)
+	case binaryVersion1:
+		return decodeBinary(buf[1:])
+	}
+	return nil, fmt.Errorf("%w 0x%02x", ErrUnknownFormat, buf[0])
+}
+
+// Encode encodes envelope into bytes for putting on wire.
+func (m *Envelope) Encode() []byte {
+	if m.Format == FormatBinary {
+		return m.encodeBinary()
+	}
+	return m.encodeJSON()
+}
+
+func decodeJSON(buf []byte) (*Envelope, error) {
 	parts := bytes.SplitN(buf, headerSeparator, 2)
 	e := &Envelope{}
 	if err := json.Unmarshal(parts[0], e); err != nil {
@@ -57,82 +191,172 @@ func Decode(buf []byte) (*Envelope, error) {
 	if len(parts) > 1 {
 		e.Body = parts[1]
 	}
+	e.Format = FormatJSON
 	return e, nil
 }
 
-// Encode encodes envelope into bytes for putting on wire.
-func (m *Envelope) Encode() []byte {
+func (m *Envelope) encodeJSON() []byte {
 	buf, _ := json.Marshal(m)
 	buf = append(buf, headerSeparator...)
 	buf = append(buf, m.Body...)
 	return buf
 }
 
-// encode implements binary encoding. Currently inactive.
-// 0 - encodes request (Method, CorrelationID, ReplyTo, ExpiresAt, Body)
-// 1 - encodes reponse (CorrelationID, Error, Body)
-func (m *Envelope) encode(et int) []byte {
-	lenBody := len(m.Body)
-	switch et {
-	case 0:
-		lenType := len(m.Method)
-		lenReplyTo := len(m.ReplyTo)
-		res := make([]byte, 15+lenType+lenReplyTo+lenBody)
-		//res[0] = uint8(0)
-		res[1] = uint8(lenType)
-		res[2] = uint8(lenReplyTo)
-		binary.BigEndian.PutUint32(res[3:7], m.CorrelationID)
-		binary.BigEndian.PutUint64(res[7:15], uint64(m.ExpiresAt))
-		pos := 15
-		copy(res[pos:pos+lenType], []byte(m.Method))
-		pos = pos + lenType
-		copy(res[pos:pos+lenReplyTo], []byte(m.ReplyTo))
-		pos = pos + lenReplyTo
-		copy(res[pos:pos+lenBody], m.Body)
-		return res
-	case 1:
-		lenError := len(m.Error)
-		res := make([]byte, 6+lenError+lenBody)
-		res[0] = uint8(1)
-		res[1] = uint8(lenError)
-		binary.BigEndian.PutUint32(res[2:6], m.CorrelationID)
-		pos := 6
-		copy(res[pos:pos+lenError], []byte(m.Error))
-		pos += lenError
-		copy(res[pos:pos+lenBody], m.Body)
-		return res
-	}
-	return nil
-}
-
-// decode implements binary decoding. Currently inactive.
-func decode(buf []byte) (*Envelope, error) {
-	m := &Envelope{}
-	switch int(buf[0]) {
-	case 0:
-		lenType := int(buf[1])
-		lenReplayTo := int(buf[2])
-		m.CorrelationID = binary.BigEndian.Uint32(buf[3:7])
-		m.ExpiresAt = int64(binary.BigEndian.Uint64(buf[7:15]))
-
-		pos := 15
-		m.Method = string(buf[pos : pos+lenType])
-		pos += lenType
-		m.ReplyTo = string(buf[pos : pos+lenReplayTo])
-		pos += lenReplayTo
-		m.Body = buf[pos:]
-
-		return m, nil
-	case 1:
-		lenError := int(buf[1])
-		m.CorrelationID = binary.BigEndian.Uint32(buf[2:6])
-		pos := 6
-		if lenError > 0 {
-			m.Error = string(buf[pos : pos+lenError])
-			pos += lenError
+// encodeBinary encodes envelope header as list of tagged fields.
+// Empty fields are omitted.
+func (m *Envelope) encodeBinary() []byte {
+	buf := make([]byte, 0, 64+len(m.Method)+len(m.ReplyTo)+len(m.Error)+len(m.Codec)+len(m.Body))
+	buf = append(buf, binaryVersion1)
+	buf = appendString(buf, tagMethod, m.Method)
+	buf = appendString(buf, tagReplyTo, m.ReplyTo)
+	if m.CorrelationID != 0 {
+		buf = appendUvarint(buf, tagCorrelationID, m.CorrelationID)
+	}
+	if m.ExpiresAt != 0 {
+		buf = appendVarint(buf, tagExpiresAt, m.ExpiresAt)
+	}
+	buf = appendString(buf, tagError, m.Error)
+	buf = appendString(buf, tagCodec, m.Codec)
+	if m.AppError != nil {
+		buf = appendField(buf, tagAppError, m.AppError.marshal())
+	}
+	if len(m.Headers) > 0 {
+		buf = appendField(buf, tagHeaders, encodeHeaders(m.Headers))
+	}
+	buf = appendString(buf, tagTraceParent, m.TraceParent)
+	buf = appendString(buf, tagTraceState, m.TraceState)
+	buf = appendString(buf, tagRequestID, m.RequestID)
+	buf = appendBool(buf, tagStream, m.Stream)
+	if m.Seq != 0 {
+		buf = appendUvarint(buf, tagSeq, m.Seq)
+	}
+	buf = appendBool(buf, tagEndOfStream, m.EndOfStream)
+	buf = append(buf, tagEnd)
+	return append(buf, m.Body...)
+}
+
+func decodeBinary(buf []byte) (*Envelope, error) {
+	m := &Envelope{Format: FormatBinary}
+	for {
+		if len(buf) == 0 {
+			return nil, errShortBuffer
+		}
+		tag := buf[0]
+		buf = buf[1:]
+		if tag == tagEnd {
+			break
+		}
+		l, n := binary.Uvarint(buf)
+		if n <= 0 || uint64(len(buf)-n) < l {
+			return nil, errShortBuffer
+		}
+		val := buf[n : n+int(l)]
+		buf = buf[n+int(l):]
+		switch tag {
+		case tagMethod:
+			m.Method = string(val)
+		case tagReplyTo:
+			m.ReplyTo = string(val)
+		case tagCorrelationID:
+			m.CorrelationID, _ = binary.Uvarint(val)
+		case tagExpiresAt:
+			m.ExpiresAt, _ = binary.Varint(val)
+		case tagError:
+			m.Error = string(val)
+		case tagCodec:
+			m.Codec = string(val)
+		case tagAppError:
+			m.AppError = unmarshalError(val)
+		case tagHeaders:
+			m.Headers = decodeHeaders(val)
+		case tagTraceParent:
+			m.TraceParent = string(val)
+		case tagTraceState:
+			m.TraceState = string(val)
+		case tagRequestID:
+			m.RequestID = string(val)
+		case tagStream:
+			m.Stream = len(val) > 0 && val[0] != 0
+		case tagSeq:
+			m.Seq, _ = binary.Uvarint(val)
+		case tagEndOfStream:
+			m.EndOfStream = len(val) > 0 && val[0] != 0
+		}
+	}
+	m.Body = buf
+	return m, nil
+}
+
+func appendString(buf []byte, tag byte, s string) []byte {
+	if s == "" {
+		return buf
+	}
+	return appendField(buf, tag, []byte(s))
+}
+
+func appendBool(buf []byte, tag byte, v bool) []byte {
+	if !v {
+		return buf
+	}
+	return appendField(buf, tag, []byte{1})
+}
+
+func appendUvarint(buf []byte, tag byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return appendField(buf, tag, tmp[:n])
+}
+
+func appendVarint(buf []byte, tag byte, v int64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(tmp[:], v)
+	return appendField(buf, tag, tmp[:n])
+}
+
+// encodeHeaders encodes headers as list of length prefixed keys and values.
+func encodeHeaders(h Headers) []byte {
+	var buf []byte
+	for k, v := range h {
+		buf = appendUvarintLen(buf, k)
+		buf = appendUvarintLen(buf, v)
+	}
+	return buf
+}
+
+func decodeHeaders(buf []byte) Headers {
+	h := make(Headers)
+	next := func() (string, bool) {
+		l, n := binary.Uvarint(buf)
+		if n <= 0 || uint64(len(buf)-n) < l {
+			return "", false
+		}
+		s := string(buf[n : n+int(l)])
+		buf = buf[n+int(l):]
+		return s, true
+	}
+	for len(buf) > 0 {
+		k, ok := next()
+		if !ok {
+			break
+		}
+		v, ok := next()
+		if !ok {
+			break
 		}
-		m.Body = buf[pos:]
-		return m, nil
+		h[k] = v
 	}
-	return nil, nil
+	return h
+}
+
+func appendUvarintLen(buf []byte, s string) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], uint64(len(s)))
+	buf = append(buf, tmp[:n]...)
+	return append(buf, s...)
+}
+
+// appendField appends tag, uvarint length and value to buf.
+func appendField(buf []byte, tag byte, val []byte) []byte {
+	buf = append(buf, tag)
+	return appendUvarintLen(buf, string(val))
 }
@@ -1,7 +1,14 @@
 package rpc
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -14,13 +21,13 @@ func TestEncodeRequest(t *testing.T) {
 		CorrelationID: 12345,
 		ExpiresAt:     expiresAt,
 		Body:          []byte("iso medo u ducan"),
+		Format:        FormatBinary,
 	}
 
-	buf := e.encode(0)
-	// fmt.Println(buf)
-	// fmt.Println(string(buf))
+	buf := e.Encode()
+	assert.Equal(t, binaryVersion1, buf[0])
 
-	e2, err := decode(buf)
+	e2, err := Decode(buf)
 	assert.Nil(t, err)
 
 	assert.Equal(t, e.Method, e2.Method)
@@ -28,12 +35,7 @@ func TestEncodeRequest(t *testing.T) {
 	assert.Equal(t, e.CorrelationID, e2.CorrelationID)
 	assert.Equal(t, e.ExpiresAt, e2.ExpiresAt)
 	assert.Equal(t, e.Body, e2.Body)
-	//assert.ObjectsAreEqual(e, e2)
-
-	// b, _ := json.Marshal(e)
-	// fmt.Printf("%s\n", b)
-	// b, _ = json.Marshal(e2)
-	// fmt.Printf("%s\n", b)
+	assert.Equal(t, FormatBinary, e2.Format)
 }
 
 func TestEncodeReply(t *testing.T) {
@@ -41,20 +43,203 @@ func TestEncodeReply(t *testing.T) {
 		Error:         "overflow",
 		CorrelationID: 12345,
 		Body:          []byte("iso medo u ducan"),
+		Format:        FormatBinary,
 	}
 
-	buf := e.encode(1)
-	// fmt.Println(buf)
-	// fmt.Println(string(buf))
+	buf := e.Encode()
 
-	e2, err := decode(buf)
+	e2, err := Decode(buf)
 	assert.Nil(t, err)
 	assert.Equal(t, e.CorrelationID, e2.CorrelationID)
 	assert.Equal(t, e.Error, e2.Error)
 	assert.Equal(t, e.Body, e2.Body)
+}
+
+func TestEncodeJSON(t *testing.T) {
+	e := &Envelope{
+		Method:        "Add",
+		ReplyTo:       "service.rsp",
+		CorrelationID: 12345,
+		Body:          []byte(`{"X":2,"Y":3}`),
+	}
+
+	buf := e.Encode()
+	assert.Equal(t, `{"m":"Add","r":"service.rsp","c":12345}`+"\n"+`{"X":2,"Y":3}`, string(buf))
+
+	e2, err := Decode(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, e, e2)
+}
+
+func TestReplyKeepsFormat(t *testing.T) {
+	for _, f := range []Format{FormatJSON, FormatBinary} {
+		req := &Envelope{Method: "Add", CorrelationID: 1, Format: f}
+		rsp, err := Decode(req.Reply([]byte("5"), nil).Encode())
+		assert.Nil(t, err)
+		assert.Equal(t, f, rsp.Format)
+		assert.Equal(t, []byte("5"), rsp.Body)
+	}
+}
+
+func TestDecodeSkipsUnknownTags(t *testing.T) {
+	buf := []byte{binaryVersion1}
+	buf = appendString(buf, tagMethod, "Add")
+	buf = appendString(buf, 0x7f, "from the future")
+	buf = append(buf, tagEnd)
+	buf = append(buf, "body"...)
+
+	e, err := Decode(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "Add", e.Method)
+	assert.Equal(t, []byte("body"), e.Body)
+}
+
+func TestDecodeErrors(t *testing.T) {
+	_, err := Decode(nil)
+	assert.NotNil(t, err)
 
-	// b, _ := json.Marshal(e)
-	// fmt.Printf("%s\n", b)
-	// b, _ = json.Marshal(e2)
-	// fmt.Printf("%s\n", b)
+	_, err = Decode([]byte{0x00, 0x01})
+	assert.True(t, errors.Is(err, ErrUnknownFormat))
+
+	// truncated binary header
+	buf := (&Envelope{Method: "Add", Format: FormatBinary}).Encode()
+	_, err = Decode(buf[:3])
+	assert.NotNil(t, err)
+}
+
+func TestReplyAppError(t *testing.T) {
+	appErr := NewError("insufficient_funds", "not enough money").WithDetail("account", "42")
+	appErr.Retryable = true
+	for _, f := range []Format{FormatJSON, FormatBinary} {
+		req := &Envelope{Method: "Pay", CorrelationID: 1, Format: f}
+		rsp, err := Decode(req.Reply(nil, fmt.Errorf("pay: %w", appErr)).Encode())
+		assert.Nil(t, err)
+		assert.Equal(t, "pay: not enough money", rsp.Error)
+		assert.Equal(t, appErr, rsp.AppError)
+
+		var e *Error
+		assert.True(t, errors.As(rsp.AppError, &e))
+		assert.True(t, errors.Is(rsp.AppError, &Error{Code: "insufficient_funds"}))
+		assert.False(t, errors.Is(rsp.AppError, &Error{Code: "overflow"}))
+	}
+	// plain errors are sent only as text
+	rsp := (&Envelope{}).Reply(nil, errors.New("overflow"))
+	assert.Equal(t, "overflow", rsp.Error)
+	assert.Nil(t, rsp.AppError)
+}
+
+func TestEncodeHeaders(t *testing.T) {
+	h := Headers{"tenant": "hr", "locale": "hr_HR", "empty": ""}
+	for _, f := range []Format{FormatJSON, FormatBinary} {
+		e := &Envelope{Method: "Add", Headers: h, Body: []byte("body"), Format: f}
+		e2, err := Decode(e.Encode())
+		assert.Nil(t, err)
+		assert.Equal(t, h, e2.Headers)
+		assert.Equal(t, e.Body, e2.Body)
+	}
+}
+
+func TestTraceContext(t *testing.T) {
+	tp := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	assert.True(t, TraceContext{TraceParent: tp}.Valid())
+	assert.False(t, TraceContext{TraceParent: ""}.Valid())
+	assert.False(t, TraceContext{TraceParent: "00-00000000000000000000000000000000-00f067aa0ba902b7-01"}.Valid())
+	assert.False(t, TraceContext{TraceParent: "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01"}.Valid())
+	assert.False(t, TraceContext{TraceParent: tp + "-00"}.Valid())
+
+	for _, f := range []Format{FormatJSON, FormatBinary} {
+		e := &Envelope{Method: "Add", Format: f}
+		e.setTraceContext(TraceContext{TraceParent: tp, TraceState: "congo=t61rcWkgMzE"})
+		e2, err := Decode(e.Encode())
+		assert.Nil(t, err)
+		assert.Equal(t, e.TraceContext(), e2.TraceContext())
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	e := &Envelope{}
+	_, ok := e.Deadline()
+	assert.False(t, ok)
+	assert.False(t, e.Expired())
+
+	d := time.Unix(1515350225, 123*int64(time.Millisecond))
+	e.SetDeadline(d)
+	assert.Equal(t, int64(1515350225123), e.ExpiresAt)
+	d2, ok := e.Deadline()
+	assert.True(t, ok)
+	assert.True(t, d.Equal(d2))
+	assert.True(t, e.Expired())
+
+	// seconds sent by older clients
+	e.ExpiresAt = 1515350225
+	d2, _ = e.Deadline()
+	assert.True(t, time.Unix(1515350225, 0).Equal(d2))
+
+	e.SetDeadline(time.Now().Add(time.Second))
+	assert.False(t, e.Expired())
+}
+
+func TestEncodeStream(t *testing.T) {
+	for _, f := range []Format{FormatJSON, FormatBinary} {
+		e := &Envelope{Method: "Export", Stream: true, Format: f}
+		e2, err := Decode(e.Encode())
+		assert.Nil(t, err)
+		assert.True(t, e2.Stream)
+
+		e = &Envelope{CorrelationID: 1, Seq: 7, EndOfStream: true, Format: f}
+		e2, err = Decode(e.Encode())
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(7), e2.Seq)
+		assert.True(t, e2.EndOfStream)
+		assert.False(t, e2.Stream)
+	}
+}
+
+// v0Envelope envelope header of the library version before binary format.
+type v0Envelope struct {
+	Method        string `json:"m,omitempty"`
+	ReplyTo       string `json:"r,omitempty"`
+	CorrelationID uint32 `json:"c,omitempty"`
+	ExpiresAt     int64  `json:"x,omitempty"`
+	Error         string `json:"e,omitempty"`
+}
+
+func decodeV0(buf []byte) (*v0Envelope, []byte, error) {
+	parts := bytes.SplitN(buf, headerSeparator, 2)
+	e := &v0Envelope{}
+	err := json.Unmarshal(parts[0], e)
+	return e, parts[1], err
+}
+
+func TestOldServerCompatibility(t *testing.T) {
+	var published [][]byte
+	p := publisherFunc(func(topic string, body []byte) error {
+		published = append(published, body)
+		return nil
+	})
+	c := NewClient(p, "service.req", "service.rsp")
+	c.msgNo = math.MaxUint64 - 1
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	headers := Headers{"k": "v"}
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, c.SendTopic(WithHeaders(ctx, headers), "service.req", "Add", []byte("body")))
+	}
+	// old server decodes requests of the json client
+	for _, buf := range published {
+		e, body, err := decodeV0(buf)
+		assert.Nil(t, err)
+		assert.Equal(t, "Add", e.Method)
+		assert.NotZero(t, e.CorrelationID)
+		assert.Equal(t, "body", string(body))
+	}
+
+	// new client decodes reply of the old server
+	e, _, _ := decodeV0(published[0])
+	header, _ := json.Marshal(&v0Envelope{CorrelationID: e.CorrelationID, Error: "overflow"})
+	rsp, err := Decode(append(append(header, '\n'), []byte("rsp")...))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(e.CorrelationID), rsp.CorrelationID)
+	assert.Equal(t, "overflow", rsp.Error)
+	assert.Equal(t, "rsp", string(rsp.Body))
 }
@@ -0,0 +1,68 @@
+package rpc
+
+import "encoding/json"
+
+// Error structured application error.
+// When application returns *Error (or error which wraps it) server sends it
+// in the reply envelope and client reconstructs it, so application errors
+// can be matched by code instead of by text.
+type Error struct {
+	// application defined error code, used for matching errors
+	Code string `json:"c,omitempty"`
+	// human readable description
+	Message string `json:"m,omitempty"`
+	// whether client can safely repeat request
+	Retryable bool `json:"r,omitempty"`
+	// optional additional information
+	Details map[string]string `json:"d,omitempty"`
+}
+
+// NewError creates application error with code and message.
+func NewError(code, message string) *Error {
+	return &Error{Code: code, Message: message}
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return e.Code
+	}
+	return e.Message
+}
+
+// ErrorCode returns error code.
+// Enables matching of the error code without importing this package.
+func (e *Error) ErrorCode() string {
+	return e.Code
+}
+
+// Is reports whether target is *Error with the same code.
+// Enables errors.Is(err, &rpc.Error{Code: "..."}).
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	if !ok {
+		return false
+	}
+	return t.Code != "" && t.Code == e.Code
+}
+
+// WithDetail adds key/value detail to the error.
+func (e *Error) WithDetail(key, value string) *Error {
+	if e.Details == nil {
+		e.Details = make(map[string]string)
+	}
+	e.Details[key] = value
+	return e
+}
+
+func (e *Error) marshal() []byte {
+	buf, _ := json.Marshal(e)
+	return buf
+}
+
+func unmarshalError(buf []byte) *Error {
+	e := &Error{}
+	if err := json.Unmarshal(buf, e); err != nil {
+		return nil
+	}
+	return e
+}
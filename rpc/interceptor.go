@@ -0,0 +1,52 @@
+package rpc
+
+import "context"
+
+// Handler handles request on the server side.
+type Handler func(ctx context.Context, method string, body []byte) ([]byte, error)
+
+// ServerInterceptor intercepts request handling on the server side.
+// Interceptor calls next to continue processing, or returns without calling
+// it to stop request from reaching application.
+// Usefull for logging, auth, metrics, rate limiting...
+type ServerInterceptor func(ctx context.Context, method string, body []byte, next Handler) ([]byte, error)
+
+// chainServer returns handler which calls interceptors in order, last
+// interceptor calls h.
+func chainServer(h Handler, interceptors []ServerInterceptor) Handler {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		h = bindServer(interceptors[i], h)
+	}
+	return h
+}
+
+func bindServer(i ServerInterceptor, next Handler) Handler {
+	return func(ctx context.Context, method string, body []byte) ([]byte, error) {
+		return i(ctx, method, body, next)
+	}
+}
+
+// Invoker sends request to the server on topic and waits for the reply.
+// Returns reply body, application error text and error (see Client.CallTopic).
+type Invoker func(ctx context.Context, topic, method string, req []byte) ([]byte, string, error)
+
+// ClientInterceptor intercepts calls on the client side.
+// Interceptor calls next to send request, it can modify context (for
+// example add headers), call next multiple times (retries) or return without
+// calling it.
+type ClientInterceptor func(ctx context.Context, topic, method string, req []byte, next Invoker) ([]byte, string, error)
+
+// chainClient returns invoker which calls interceptors in order, last
+// interceptor calls inv.
+func chainClient(inv Invoker, interceptors []ClientInterceptor) Invoker {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		inv = bindClient(interceptors[i], inv)
+	}
+	return inv
+}
+
+func bindClient(i ClientInterceptor, next Invoker) Invoker {
+	return func(ctx context.Context, topic, method string, req []byte) ([]byte, string, error) {
+		return i(ctx, topic, method, req, next)
+	}
+}
@@ -0,0 +1,66 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerInterceptorsOrder(t *testing.T) {
+	var calls []string
+	trace := func(name string) ServerInterceptor {
+		return func(ctx context.Context, method string, body []byte, next Handler) ([]byte, error) {
+			calls = append(calls, name)
+			return next(ctx, method, body)
+		}
+	}
+	h := func(ctx context.Context, method string, body []byte) ([]byte, error) {
+		calls = append(calls, "app")
+		return body, nil
+	}
+
+	rsp, err := chainServer(h, []ServerInterceptor{trace("first"), trace("second")})(context.Background(), "Add", []byte("body"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("body"), rsp)
+	assert.Equal(t, []string{"first", "second", "app"}, calls)
+}
+
+func TestServerInterceptorShortCircuit(t *testing.T) {
+	errDenied := errors.New("denied")
+	auth := func(ctx context.Context, method string, body []byte, next Handler) ([]byte, error) {
+		if HeadersFromContext(ctx)["token"] == "" {
+			return nil, errDenied
+		}
+		return next(ctx, method, body)
+	}
+	h := func(ctx context.Context, method string, body []byte) ([]byte, error) {
+		t.Fatal("application should not be called")
+		return nil, nil
+	}
+
+	_, err := chainServer(h, []ServerInterceptor{auth})(context.Background(), "Add", nil)
+	assert.Equal(t, errDenied, err)
+}
+
+func TestClientInterceptors(t *testing.T) {
+	var calls []string
+	logging := func(ctx context.Context, topic, method string, req []byte, next Invoker) ([]byte, string, error) {
+		calls = append(calls, "logging "+topic+" "+method)
+		return next(ctx, topic, method, req)
+	}
+	tenant := func(ctx context.Context, topic, method string, req []byte, next Invoker) ([]byte, string, error) {
+		return next(WithHeaders(ctx, Headers{"tenant": "hr"}), topic, method, req)
+	}
+	inv := func(ctx context.Context, topic, method string, req []byte) ([]byte, string, error) {
+		calls = append(calls, "send "+outgoingHeaders(ctx)["tenant"])
+		return req, "", nil
+	}
+
+	rsp, appErr, err := chainClient(inv, []ClientInterceptor{logging, tenant})(context.Background(), "service.req", "Add", []byte("body"))
+	assert.Nil(t, err)
+	assert.Equal(t, "", appErr)
+	assert.Equal(t, []byte("body"), rsp)
+	assert.Equal(t, []string{"logging service.req Add", "send hr"}, calls)
+}
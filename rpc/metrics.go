@@ -0,0 +1,81 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Metrics collects metrics of rpc client calls and server requests.
+// See rpc/prometheus for Prometheus implementation.
+type Metrics interface {
+	// ClientCall observes completed client call to method on topic, with
+	// all retries. Err is call result, see ErrorKind.
+	ClientCall(topic, method string, d time.Duration, err error)
+	// ClientPending changes number of requests to topic waiting for reply.
+	ClientPending(topic string, delta int)
+	// LateReply reply received on topic after client stopped waiting for it.
+	LateReply(topic string)
+	// ServerRequest observes request processed by server application.
+	ServerRequest(method string, d time.Duration, err error)
+	// ServerExpired request dropped because its deadline passed.
+	ServerExpired(method string)
+	// ServerRequeued request requeued by server.
+	ServerRequeued(method string)
+}
+
+// Error kinds returned by ErrorKind.
+const (
+	ErrorKindTimeout  = "timeout"
+	ErrorKindCanceled = "canceled"
+	ErrorKindPublish  = "publish"
+	ErrorKindApp      = "app"
+	ErrorKindOther    = "other"
+)
+
+// ErrorKind classifies error of the call or request for metric labels.
+// Returns empty string for nil error.
+func ErrorKind(err error) string {
+	var pe *PublishError
+	var ae *Error
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, ErrAttemptTimeout):
+		return ErrorKindTimeout
+	case errors.Is(err, context.Canceled):
+		return ErrorKindCanceled
+	case errors.As(err, &pe):
+		return ErrorKindPublish
+	case errors.As(err, &ae):
+		return ErrorKindApp
+	}
+	return ErrorKindOther
+}
+
+// SetMetrics sets collector of client metrics.
+// Must be called before first request.
+func (c *Client) SetMetrics(m Metrics) {
+	if m == nil {
+		m = noopMetrics{}
+	}
+	c.metrics = m
+}
+
+// SetMetrics sets collector of server metrics.
+// Must be called before server receives first message.
+func (s *Server) SetMetrics(m Metrics) {
+	if m == nil {
+		m = noopMetrics{}
+	}
+	s.metrics = m
+}
+
+type noopMetrics struct{}
+
+func (noopMetrics) ClientCall(topic, method string, d time.Duration, err error) {}
+func (noopMetrics) ClientPending(topic string, delta int)                       {}
+func (noopMetrics) LateReply(topic string)                                      {}
+func (noopMetrics) ServerRequest(method string, d time.Duration, err error)     {}
+func (noopMetrics) ServerExpired(method string)                                 {}
+func (noopMetrics) ServerRequeued(method string)                                {}
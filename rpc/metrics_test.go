@@ -0,0 +1,60 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type recordMetrics struct {
+	noopMetrics
+	events []string
+}
+
+func (r *recordMetrics) ServerRequest(method string, d time.Duration, err error) {
+	r.events = append(r.events, fmt.Sprintf("request %s %s", method, ErrorKind(err)))
+}
+func (r *recordMetrics) ServerExpired(method string) { r.events = append(r.events, "expired "+method) }
+func (r *recordMetrics) ServerRequeued(method string) {
+	r.events = append(r.events, "requeued "+method)
+}
+
+func TestErrorKind(t *testing.T) {
+	assert.Equal(t, "", ErrorKind(nil))
+	assert.Equal(t, ErrorKindTimeout, ErrorKind(context.DeadlineExceeded))
+	assert.Equal(t, ErrorKindTimeout, ErrorKind(ErrAttemptTimeout))
+	assert.Equal(t, ErrorKindCanceled, ErrorKind(context.Canceled))
+	assert.Equal(t, ErrorKindPublish, ErrorKind(&PublishError{Err: errors.New("E_BAD_TOPIC")}))
+	assert.Equal(t, ErrorKindApp, ErrorKind(NewError("overflow", "")))
+	assert.Equal(t, ErrorKindApp, ErrorKind(callError("overflow", nil)))
+	assert.Equal(t, ErrorKindOther, ErrorKind(errors.New("other")))
+}
+
+func TestServerMetrics(t *testing.T) {
+	app := appServerFunc(func(ctx context.Context, method string, req []byte) ([]byte, error) {
+		if method == "Fail" {
+			return nil, NewError("overflow", "")
+		}
+		return nil, context.Canceled
+	})
+	s := NewServer(context.Background(), app, nil)
+	r := &recordMetrics{}
+	s.SetMetrics(r)
+
+	s.Handle((&Envelope{Method: "Fail"}).Encode(), &fakeMessage{})
+	s.Handle((&Envelope{Method: "Add"}).Encode(), &fakeMessage{})
+	expired := &Envelope{Method: "Add"}
+	expired.SetDeadline(time.Now().Add(-time.Second))
+	s.Handle(expired.Encode(), &fakeMessage{})
+
+	assert.Equal(t, []string{
+		"request Fail app",
+		"request Add canceled",
+		"requeued Add",
+		"expired Add",
+	}, r.events)
+}
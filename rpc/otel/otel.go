@@ -0,0 +1,102 @@
+// Package otel implements rpc.Tracer using OpenTelemetry.
+package otel
+
+import (
+	"context"
+
+	"github.com/minus5/nsqm/rpc"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	instrumentationName = "github.com/minus5/nsqm/rpc"
+	traceParentHeader   = "traceparent"
+	traceStateHeader    = "tracestate"
+)
+
+// Tracer creates OpenTelemetry spans for rpc client and server.
+type Tracer struct {
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+}
+
+// New creates Tracer from OpenTelemetry tracer provider.
+func New(tp trace.TracerProvider) *Tracer {
+	return &Tracer{
+		tracer:     tp.Tracer(instrumentationName),
+		propagator: propagation.TraceContext{},
+	}
+}
+
+// Global creates Tracer from globally registered tracer provider.
+func Global() *Tracer {
+	return New(otel.GetTracerProvider())
+}
+
+// StartSpan implements rpc.Tracer.
+func (t *Tracer) StartSpan(ctx context.Context, kind rpc.SpanKind, topic, method string) (context.Context, rpc.Span) {
+	attrs := []attribute.KeyValue{
+		attribute.String("rpc.system", "nsqm"),
+		attribute.String("rpc.method", method),
+		attribute.String("messaging.system", "nsq"),
+	}
+	name := method
+	if topic != "" {
+		name = topic + " " + method
+		attrs = append(attrs, attribute.String("messaging.destination.name", topic))
+	}
+	ctx, s := t.tracer.Start(ctx, name,
+		trace.WithSpanKind(spanKind(kind)),
+		trace.WithAttributes(attrs...))
+	return ctx, span{s}
+}
+
+// Inject implements rpc.Tracer.
+func (t *Tracer) Inject(ctx context.Context) rpc.TraceContext {
+	c := propagation.MapCarrier{}
+	t.propagator.Inject(ctx, c)
+	return rpc.TraceContext{
+		TraceParent: c[traceParentHeader],
+		TraceState:  c[traceStateHeader],
+	}
+}
+
+// Extract implements rpc.Tracer.
+func (t *Tracer) Extract(ctx context.Context, tc rpc.TraceContext) context.Context {
+	if !tc.Valid() {
+		return ctx
+	}
+	c := propagation.MapCarrier{traceParentHeader: tc.TraceParent}
+	if tc.TraceState != "" {
+		c[traceStateHeader] = tc.TraceState
+	}
+	return t.propagator.Extract(ctx, c)
+}
+
+func spanKind(k rpc.SpanKind) trace.SpanKind {
+	switch k {
+	case rpc.SpanClient:
+		return trace.SpanKindClient
+	case rpc.SpanServer:
+		return trace.SpanKindServer
+	case rpc.SpanProducer:
+		return trace.SpanKindProducer
+	}
+	return trace.SpanKindInternal
+}
+
+type span struct {
+	trace.Span
+}
+
+func (s span) End(err error) {
+	if err != nil {
+		s.Span.RecordError(err)
+		s.Span.SetStatus(codes.Error, err.Error())
+	}
+	s.Span.End()
+}
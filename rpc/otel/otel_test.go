@@ -0,0 +1,51 @@
+package otel
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/minus5/nsqm/rpc"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracer(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	tr := New(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec)))
+
+	// client side
+	ctx, client := tr.StartSpan(context.Background(), rpc.SpanClient, "service.req", "Add")
+	tc := tr.Inject(ctx)
+	assert.True(t, tc.Valid())
+
+	// server side continues trace received in the envelope
+	sctx := tr.Extract(context.Background(), tc)
+	sctx, server := tr.StartSpan(sctx, rpc.SpanServer, "", "Add")
+	_, producer := tr.StartSpan(sctx, rpc.SpanProducer, "service.rsp", "Add")
+	producer.End(errors.New("E_BAD_TOPIC"))
+	server.End(nil)
+	client.End(nil)
+
+	spans := rec.Ended()
+	assert.Len(t, spans, 3)
+	p, s, c := spans[0], spans[1], spans[2]
+	assert.Equal(t, trace.SpanKindProducer, p.SpanKind())
+	assert.Equal(t, trace.SpanKindServer, s.SpanKind())
+	assert.Equal(t, trace.SpanKindClient, c.SpanKind())
+	assert.Equal(t, "service.req Add", c.Name())
+	assert.Equal(t, "Add", s.Name())
+
+	// one trace, server span is child of the remote client span
+	assert.Equal(t, c.SpanContext().TraceID(), s.SpanContext().TraceID())
+	assert.Equal(t, c.SpanContext().SpanID(), s.Parent().SpanID())
+	assert.True(t, s.Parent().IsRemote())
+	assert.Equal(t, s.SpanContext().SpanID(), p.Parent().SpanID())
+	assert.Equal(t, codes.Error, p.Status().Code)
+
+	// invalid trace context is ignored
+	assert.Equal(t, context.Background(), tr.Extract(context.Background(), rpc.TraceContext{TraceParent: "x"}))
+}
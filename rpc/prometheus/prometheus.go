@@ -0,0 +1,185 @@
+// Package prometheus implements rpc.Metrics with Prometheus metrics.
+package prometheus
+
+import (
+	"sync"
+	"time"
+
+	"github.com/minus5/nsqm/rpc"
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "nsqm_rpc"
+
+// OtherMethod method label of server requests for methods which are not
+// allowed, or over MaxMethods.
+const OtherMethod = "other"
+
+// MaxMethods number of distinct method labels of server metrics when
+// methods are not listed in New. Method name comes from the request, so
+// clients sending arbitrary names can't create unbounded label values.
+var MaxMethods = 100
+
+// Metrics collects rpc client and server metrics.
+// It is prometheus.Collector, register it before use:
+//
+//	m := prometheus.New()
+//	prom.MustRegister(m)
+//	cfg.Metrics = m
+type Metrics struct {
+	clientCalls    *prom.CounterVec
+	clientErrors   *prom.CounterVec
+	clientLatency  *prom.HistogramVec
+	clientPending  *prom.GaugeVec
+	lateReplies    *prom.CounterVec
+	serverRequests *prom.CounterVec
+	serverErrors   *prom.CounterVec
+	serverLatency  *prom.HistogramVec
+	serverExpired  *prom.CounterVec
+	serverRequeued *prom.CounterVec
+	methods        map[string]bool
+	fixedMethods   bool
+	sync.Mutex
+}
+
+// New creates metrics with default latency buckets.
+// Server metrics are labeled with methods, other methods with OtherMethod.
+// Without methods first MaxMethods seen methods are used.
+func New(methods ...string) *Metrics {
+	m := &Metrics{
+		methods:      make(map[string]bool),
+		fixedMethods: len(methods) > 0,
+		clientCalls: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: namespace,
+			Name:      "client_calls_total",
+			Help:      "Number of completed rpc client calls.",
+		}, []string{"topic", "method"}),
+		clientErrors: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: namespace,
+			Name:      "client_errors_total",
+			Help:      "Number of failed rpc client calls by error kind.",
+		}, []string{"topic", "method", "kind"}),
+		clientLatency: prom.NewHistogramVec(prom.HistogramOpts{
+			Namespace: namespace,
+			Name:      "client_call_duration_seconds",
+			Help:      "Duration of rpc client calls, including retries.",
+			Buckets:   prom.DefBuckets,
+		}, []string{"topic", "method"}),
+		clientPending: prom.NewGaugeVec(prom.GaugeOpts{
+			Namespace: namespace,
+			Name:      "client_pending",
+			Help:      "Number of rpc client requests waiting for reply.",
+		}, []string{"topic"}),
+		lateReplies: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: namespace,
+			Name:      "client_late_replies_total",
+			Help:      "Number of replies received after client stopped waiting.",
+		}, []string{"topic"}),
+		serverRequests: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: namespace,
+			Name:      "server_requests_total",
+			Help:      "Number of requests processed by rpc server.",
+		}, []string{"method"}),
+		serverErrors: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: namespace,
+			Name:      "server_errors_total",
+			Help:      "Number of requests failed in rpc server by error kind.",
+		}, []string{"method", "kind"}),
+		serverLatency: prom.NewHistogramVec(prom.HistogramOpts{
+			Namespace: namespace,
+			Name:      "server_request_duration_seconds",
+			Help:      "Duration of request processing in rpc server application.",
+			Buckets:   prom.DefBuckets,
+		}, []string{"method"}),
+		serverExpired: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: namespace,
+			Name:      "server_expired_total",
+			Help:      "Number of requests dropped after their deadline.",
+		}, []string{"method"}),
+		serverRequeued: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: namespace,
+			Name:      "server_requeued_total",
+			Help:      "Number of requests requeued by rpc server.",
+		}, []string{"method"}),
+	}
+	for _, method := range methods {
+		m.methods[method] = true
+	}
+	return m
+}
+
+// method returns label for the server method.
+func (m *Metrics) method(name string) string {
+	m.Lock()
+	defer m.Unlock()
+	if m.methods[name] {
+		return name
+	}
+	if m.fixedMethods || len(m.methods) >= MaxMethods {
+		return OtherMethod
+	}
+	m.methods[name] = true
+	return name
+}
+
+func (m *Metrics) collectors() []prom.Collector {
+	return []prom.Collector{
+		m.clientCalls, m.clientErrors, m.clientLatency, m.clientPending, m.lateReplies,
+		m.serverRequests, m.serverErrors, m.serverLatency, m.serverExpired, m.serverRequeued,
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (m *Metrics) Describe(ch chan<- *prom.Desc) {
+	for _, c := range m.collectors() {
+		c.Describe(ch)
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (m *Metrics) Collect(ch chan<- prom.Metric) {
+	for _, c := range m.collectors() {
+		c.Collect(ch)
+	}
+}
+
+// ClientCall implements rpc.Metrics.
+func (m *Metrics) ClientCall(topic, method string, d time.Duration, err error) {
+	m.clientCalls.WithLabelValues(topic, method).Inc()
+	m.clientLatency.WithLabelValues(topic, method).Observe(d.Seconds())
+	if err != nil {
+		m.clientErrors.WithLabelValues(topic, method, rpc.ErrorKind(err)).Inc()
+	}
+}
+
+// ClientPending implements rpc.Metrics.
+func (m *Metrics) ClientPending(topic string, delta int) {
+	m.clientPending.WithLabelValues(topic).Add(float64(delta))
+}
+
+// LateReply implements rpc.Metrics.
+func (m *Metrics) LateReply(topic string) {
+	m.lateReplies.WithLabelValues(topic).Inc()
+}
+
+// ServerRequest implements rpc.Metrics.
+func (m *Metrics) ServerRequest(method string, d time.Duration, err error) {
+	method = m.method(method)
+	m.serverRequests.WithLabelValues(method).Inc()
+	m.serverLatency.WithLabelValues(method).Observe(d.Seconds())
+	if err != nil {
+		m.serverErrors.WithLabelValues(method, rpc.ErrorKind(err)).Inc()
+	}
+}
+
+// ServerExpired implements rpc.Metrics.
+func (m *Metrics) ServerExpired(method string) {
+	method = m.method(method)
+	m.serverExpired.WithLabelValues(method).Inc()
+}
+
+// ServerRequeued implements rpc.Metrics.
+func (m *Metrics) ServerRequeued(method string) {
+	method = m.method(method)
+	m.serverRequeued.WithLabelValues(method).Inc()
+}
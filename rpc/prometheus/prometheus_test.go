@@ -0,0 +1,49 @@
+package prometheus
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	m := New()
+	assert.Nil(t, prom.NewRegistry().Register(m))
+
+	m.ClientPending("service.req", 2)
+	m.ClientPending("service.req", -1)
+	m.ClientCall("service.req", "Add", time.Millisecond, nil)
+	m.ClientCall("service.req", "Add", time.Second, context.DeadlineExceeded)
+	m.ServerExpired("Add")
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.clientPending))
+	assert.Equal(t, float64(2), testutil.ToFloat64(m.clientCalls))
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.clientErrors.WithLabelValues("service.req", "Add", "timeout")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.serverExpired))
+}
+
+func TestServerMethodLabels(t *testing.T) {
+	m := New("Add")
+	m.ServerRequest("Add", time.Millisecond, nil)
+	m.ServerRequest("Bogus1", time.Millisecond, nil)
+	m.ServerExpired("Bogus2")
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.serverRequests.WithLabelValues("Add")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.serverRequests.WithLabelValues(OtherMethod)))
+	assert.Equal(t, 2, testutil.CollectAndCount(m.serverRequests))
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.serverExpired.WithLabelValues(OtherMethod)))
+
+	// without allowed methods number of labels is limited
+	defer func(n int) { MaxMethods = n }(MaxMethods)
+	MaxMethods = 2
+	m = New()
+	for _, method := range []string{"a", "b", "c", "d", "a"} {
+		m.ServerRequeued(method)
+	}
+	assert.Equal(t, 3, testutil.CollectAndCount(m.serverRequeued))
+	assert.Equal(t, float64(2), testutil.ToFloat64(m.serverRequeued.WithLabelValues("a")))
+	assert.Equal(t, float64(2), testutil.ToFloat64(m.serverRequeued.WithLabelValues(OtherMethod)))
+}
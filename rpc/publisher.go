@@ -0,0 +1,71 @@
+package rpc
+
+import (
+	"errors"
+	"time"
+)
+
+// Publisher publishes messages to topics.
+// Implemented by *nsq.Producer and producer of the memory package. Wrap it
+// to instrument publishing, or implement it to use other broker.
+type Publisher interface {
+	Publish(topic string, body []byte) error
+}
+
+// MultiPublisher is implemented by publishers which publish multiple
+// messages at once. Used for batching, without it messages are published
+// one by one.
+type MultiPublisher interface {
+	MultiPublish(topic string, body [][]byte) error
+}
+
+// DeferredPublisher is implemented by publishers which can delay delivery
+// of the message. Required for deferred requests.
+type DeferredPublisher interface {
+	DeferredPublish(topic string, delay time.Duration, body []byte) error
+}
+
+// AsyncPublisher is implemented by publishers which publish without waiting
+// for broker acknowledge. Required for async publishing, without it
+// publishing is synchronous.
+// PublishAsync calls done with the publish result when broker acknowledges
+// it. Done is not called when PublishAsync returns error.
+// Producers created by nsqm adapt *nsq.Producer PublishAsync to it.
+type AsyncPublisher interface {
+	PublishAsync(topic string, body []byte, done func(error)) error
+}
+
+// Message operations used by rpc client and server on the received message.
+// Implemented by *nsq.Message.
+type Message interface {
+	Finish()
+	Requeue(delay time.Duration)
+	RequeueWithoutBackoff(delay time.Duration)
+	Touch()
+	DisableAutoResponse()
+}
+
+// ErrDeferredNotSupported publisher doesn't implement DeferredPublisher.
+var ErrDeferredNotSupported = errors.New("deferred publish not supported by publisher")
+
+// multiPublish publishes all bodies, with MultiPublish if supported.
+func multiPublish(p Publisher, topic string, bodies [][]byte) error {
+	if mp, ok := p.(MultiPublisher); ok {
+		return mp.MultiPublish(topic, bodies)
+	}
+	for _, body := range bodies {
+		if err := p.Publish(topic, body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deferredPublish publishes body which is delivered after delay.
+func deferredPublish(p Publisher, topic string, delay time.Duration, body []byte) error {
+	dp, ok := p.(DeferredPublisher)
+	if !ok {
+		return ErrDeferredNotSupported
+	}
+	return dp.DeferredPublish(topic, delay, body)
+}
@@ -0,0 +1,70 @@
+package rpc
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// publisherFunc implements only Publish.
+type publisherFunc func(topic string, body []byte) error
+
+func (f publisherFunc) Publish(topic string, body []byte) error {
+	return f(topic, body)
+}
+
+type fakeMessage struct {
+	finished, requeued, touched int
+	noAutoResponse              bool
+	sync.Mutex
+}
+
+func (m *fakeMessage) Finish()                                   { m.Lock(); m.finished++; m.Unlock() }
+func (m *fakeMessage) Requeue(delay time.Duration)               { m.Lock(); m.requeued++; m.Unlock() }
+func (m *fakeMessage) RequeueWithoutBackoff(delay time.Duration) { m.Requeue(delay) }
+func (m *fakeMessage) Touch()                                    { m.Lock(); m.touched++; m.Unlock() }
+func (m *fakeMessage) DisableAutoResponse()                      { m.noAutoResponse = true }
+
+func TestServerHandleWithFakes(t *testing.T) {
+	var published []*Envelope
+	p := publisherFunc(func(topic string, body []byte) error {
+		assert.Equal(t, "service.rsp", topic)
+		e, err := Decode(body)
+		assert.Nil(t, err)
+		published = append(published, e)
+		return nil
+	})
+	app := appServerFunc(func(ctx context.Context, method string, req []byte) ([]byte, error) {
+		return append([]byte("re: "), req...), nil
+	})
+	s := NewServer(context.Background(), app, p)
+	// publisher without PublishAsync falls back to synchronous replies
+	s.SetAsyncPublish(8)
+	assert.Nil(t, s.async)
+
+	m := &fakeMessage{}
+	req := &Envelope{Method: "Add", ReplyTo: "service.rsp", CorrelationID: 1, Body: []byte("1")}
+	assert.Nil(t, s.Handle(req.Encode(), m))
+	assert.False(t, m.noAutoResponse)
+	assert.Equal(t, 0, m.requeued)
+	assert.Len(t, published, 1)
+	assert.Equal(t, uint64(1), published[0].CorrelationID)
+	assert.Equal(t, "re: 1", string(published[0].Body))
+}
+
+func TestPublisherFallbacks(t *testing.T) {
+	var bodies []string
+	p := publisherFunc(func(topic string, body []byte) error {
+		bodies = append(bodies, string(body))
+		return nil
+	})
+	assert.Nil(t, multiPublish(p, "service.req", [][]byte{[]byte("a"), []byte("b")}))
+	assert.Equal(t, []string{"a", "b"}, bodies)
+
+	c := NewClient(p, "service.req", "service.rsp")
+	err := c.SendDeferredTopic(context.Background(), "service.req", "Add", time.Second, nil)
+	assert.Contains(t, err.Error(), ErrDeferredNotSupported.Error())
+}
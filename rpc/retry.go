@@ -0,0 +1,130 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// ErrAttemptTimeout reply for single attempt didn't arrive in
+// RetryPolicy.AttemptTimeout.
+var ErrAttemptTimeout = errors.New("rpc attempt timeout")
+
+// PublishError request could not be published to nsqd.
+type PublishError struct {
+	Err error
+}
+
+func (e *PublishError) Error() string {
+	return "nsq publish failed: " + e.Err.Error()
+}
+
+// Unwrap returns underlying nsq error.
+func (e *PublishError) Unwrap() error {
+	return e.Err
+}
+
+// RetryPolicy configures automatic retries of client calls.
+// Only calls to idempotent methods are retried. Each attempt is sent with new
+// correlationID, late replies of the previous attempts are ignored.
+type RetryPolicy struct {
+	// MaxAttempts number of attempts including the first one.
+	MaxAttempts int
+	// AttemptTimeout how long to wait for the reply of single attempt.
+	// Zero waits until call context is done, so only failed publishes are retried.
+	AttemptTimeout time.Duration
+	// InitialBackoff wait before second attempt, default 100ms.
+	InitialBackoff time.Duration
+	// MaxBackoff maximal wait between attempts, default 10s.
+	MaxBackoff time.Duration
+	// Multiplier of the backoff for each next attempt, default 2.
+	Multiplier float64
+	// Jitter fraction (0-1) of the backoff which is randomized.
+	Jitter float64
+	// Idempotent reports whether method can be safely retried.
+	// Nil means that no method is retried.
+	Idempotent func(method string) bool
+	// Retryable reports whether error can be retried.
+	// Default is DefaultRetryable.
+	Retryable func(err error) bool
+}
+
+// Methods returns function which reports methods as idempotent.
+// Usefull for RetryPolicy.Idempotent.
+func Methods(methods ...string) func(method string) bool {
+	m := make(map[string]bool)
+	for _, name := range methods {
+		m[name] = true
+	}
+	return func(method string) bool {
+		return m[method]
+	}
+}
+
+// DefaultRetryable retries failed publishes, attempt timeouts and
+// application errors marked as retryable.
+func DefaultRetryable(err error) bool {
+	var pe *PublishError
+	if errors.As(err, &pe) {
+		return true
+	}
+	if errors.Is(err, ErrAttemptTimeout) {
+		return true
+	}
+	var ae *Error
+	if errors.As(err, &ae) {
+		return ae.Retryable
+	}
+	return false
+}
+
+// attempts returns number of attempts for method.
+func (p *RetryPolicy) attempts(method string) int {
+	if p == nil || p.MaxAttempts <= 1 || p.Idempotent == nil || !p.Idempotent(method) {
+		return 1
+	}
+	return p.MaxAttempts
+}
+
+func (p *RetryPolicy) retryable(err error) bool {
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	return DefaultRetryable(err)
+}
+
+// backoff returns wait before attempt n (n > 1).
+func (p *RetryPolicy) backoff(n int) time.Duration {
+	initial, max, mul := p.InitialBackoff, p.MaxBackoff, p.Multiplier
+	if initial <= 0 {
+		initial = 100 * time.Millisecond
+	}
+	if max <= 0 {
+		max = 10 * time.Second
+	}
+	if mul <= 1 {
+		mul = 2
+	}
+	d := float64(initial) * math.Pow(mul, float64(n-2))
+	if d > float64(max) {
+		d = float64(max)
+	}
+	if p.Jitter > 0 {
+		d -= d * math.Min(p.Jitter, 1) * rand.Float64()
+	}
+	return time.Duration(d)
+}
+
+// sleep waits for d or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,149 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	p := &RetryPolicy{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	assert.Equal(t, 100*time.Millisecond, p.backoff(2))
+	assert.Equal(t, 200*time.Millisecond, p.backoff(3))
+	assert.Equal(t, 800*time.Millisecond, p.backoff(5))
+	assert.Equal(t, time.Second, p.backoff(6))
+
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		d := p.backoff(3)
+		assert.True(t, d > 100*time.Millisecond && d <= 200*time.Millisecond, d)
+	}
+}
+
+func TestRetryAttempts(t *testing.T) {
+	var p *RetryPolicy
+	assert.Equal(t, 1, p.attempts("Get"))
+
+	p = &RetryPolicy{MaxAttempts: 3}
+	assert.Equal(t, 1, p.attempts("Get"))
+
+	p.Idempotent = Methods("Get", "List")
+	assert.Equal(t, 3, p.attempts("Get"))
+	assert.Equal(t, 1, p.attempts("Pay"))
+}
+
+func TestDefaultRetryable(t *testing.T) {
+	assert.True(t, DefaultRetryable(&PublishError{Err: errors.New("connection refused")}))
+	assert.True(t, DefaultRetryable(fmt.Errorf("call: %w", ErrAttemptTimeout)))
+	assert.True(t, DefaultRetryable(&Error{Code: "busy", Retryable: true}))
+	assert.False(t, DefaultRetryable(&Error{Code: "overflow"}))
+	assert.False(t, DefaultRetryable(context.DeadlineExceeded))
+	assert.False(t, DefaultRetryable(errors.New("unknown")))
+}
+
+// newRetryClient creates client with retry policy whose requests are answered
+// with reply (nil for no reply). Returns published requests.
+func newRetryClient(p *RetryPolicy, reply func(n int, req *Envelope) *Envelope) (*Client, *[]*Envelope) {
+	var reqs []*Envelope
+	var c *Client
+	c = NewClient(publisherFunc(func(topic string, body []byte) error {
+		req, _ := Decode(body)
+		reqs = append(reqs, req)
+		if rsp := reply(len(reqs), req); rsp != nil {
+			c.Handle(rsp.Encode(), &fakeMessage{})
+		}
+		return nil
+	}), "service.req", "service.rsp")
+	c.SetRetryPolicy(p)
+	return c, &reqs
+}
+
+func testRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts:    3,
+		AttemptTimeout: 20 * time.Millisecond,
+		InitialBackoff: time.Millisecond,
+		Idempotent:     Methods("Get"),
+	}
+}
+
+func TestRetryReusesRequestID(t *testing.T) {
+	c, reqs := newRetryClient(testRetryPolicy(), func(n int, req *Envelope) *Envelope {
+		if n == 1 {
+			return req.Reply(nil, &Error{Code: "busy", Retryable: true})
+		}
+		return req.Reply([]byte("ok"), nil)
+	})
+	rsp, _, err := c.Call(context.Background(), "Get", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "ok", string(rsp))
+	assert.Len(t, *reqs, 2)
+	first, second := (*reqs)[0], (*reqs)[1]
+	assert.NotEmpty(t, first.RequestID)
+	assert.Equal(t, first.RequestID, second.RequestID)
+	assert.NotEqual(t, first.CorrelationID, second.CorrelationID)
+}
+
+func TestRetryStopsOnNonRetryableError(t *testing.T) {
+	c, reqs := newRetryClient(testRetryPolicy(), func(n int, req *Envelope) *Envelope {
+		return req.Reply(nil, NewError("not_found", ""))
+	})
+	_, _, err := c.Call(context.Background(), "Get", nil)
+	assert.True(t, errors.Is(err, &Error{Code: "not_found"}))
+	assert.Len(t, *reqs, 1)
+}
+
+func TestRetryHonorsCallDeadline(t *testing.T) {
+	p := testRetryPolicy()
+	p.MaxAttempts = 100
+	c, reqs := newRetryClient(p, func(n int, req *Envelope) *Envelope { return nil })
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, _, err := c.Call(ctx, "Get", nil)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.True(t, time.Since(start) < time.Second)
+	assert.True(t, len(*reqs) > 1 && len(*reqs) < 10)
+}
+
+func TestRetryIgnoresLateReply(t *testing.T) {
+	var c *Client
+	var first *Envelope
+	c, reqs := newRetryClient(testRetryPolicy(), func(n int, req *Envelope) *Envelope {
+		if n == 1 {
+			first = req
+			return nil
+		}
+		// reply of the timed out attempt arrives during the second one
+		late := req.Reply([]byte("late"), nil)
+		late.CorrelationID = first.CorrelationID
+		c.Handle(late.Encode(), &fakeMessage{})
+		return req.Reply([]byte("ok"), nil)
+	})
+	rsp, _, err := c.Call(context.Background(), "Get", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "ok", string(rsp))
+	assert.Len(t, *reqs, 2)
+}
+
+func TestRetryTimedOutAttemptsSwept(t *testing.T) {
+	c, reqs := newRetryClient(testRetryPolicy(), func(n int, req *Envelope) *Envelope { return nil })
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	_, _, err := c.Call(context.Background(), "Get", nil)
+	assert.Equal(t, ErrAttemptTimeout, err)
+	assert.Len(t, *reqs, 3)
+	// replies of timed out attempts are still recognized as late
+	assert.Len(t, c.subscribers, 3)
+	assert.Equal(t, 0, c.Pending())
+
+	// replies lost, removed after late reply window
+	now = now.Add(2 * lateReplyWindow)
+	c.add(1, make(chan *Envelope, 1))
+	assert.Len(t, c.subscribers, 1)
+	assert.Len(t, c.timedOut, 0)
+}
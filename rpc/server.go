@@ -3,8 +3,11 @@ package rpc
 import (
 	"context"
 	"fmt"
+	"runtime/debug"
+	"sync"
 	"time"
 
+	"github.com/minus5/nsqm/log"
 	"github.com/nsqio/go-nsq"
 	"github.com/pkg/errors"
 )
@@ -22,66 +25,333 @@ type appServer interface {
 	Serve(ctx context.Context, typ string, req []byte) ([]byte, error)
 }
 
+// streamServer is implemented by appServers which reply to stream requests
+// with multiple messages. Each body passed to send is published as one reply,
+// send must not be called after ServeStream returns.
+type streamServer interface {
+	ServeStream(ctx context.Context, typ string, req []byte, send func([]byte) error) error
+}
+
+// codecer is implemented by appServers which accept only one body codec.
+// Requests marked with different codec are rejected.
+type codecer interface {
+	Codec() string
+}
+
+// CodeInternal code of the error sent to the client when application panics.
+const CodeInternal = "internal"
+
+// panicError application panic, replied to the client as *Error with
+// CodeInternal. New one is created for each panic so replies don't share it.
+type panicError struct {
+	err *Error
+}
+
+func newPanicError() error {
+	return &panicError{err: NewError(CodeInternal, "internal server error")}
+}
+
+func (e *panicError) Error() string { return e.err.Error() }
+func (e *panicError) Unwrap() error { return e.err }
+
+func isPanic(err error) bool {
+	var pe *panicError
+	return errors.As(err, &pe)
+}
+
+// PanicPolicy what to do with the message when application panics.
+type PanicPolicy int
+
+const (
+	// PanicFinish replies with internal error and finishes the message.
+	PanicFinish PanicPolicy = iota
+	// PanicRequeue requeues the message without reply, so it will be
+	// processed again. Use nsq MaxAttempts to limit redeliveries.
+	PanicRequeue
+)
+
 // Server rpc server side.
 type Server struct {
-	ctx      context.Context
-	srv      appServer
-	producer *nsq.Producer
+	ctx          context.Context
+	srv          appServer
+	handler      Handler
+	interceptors []ServerInterceptor
+	producer     Publisher
+	tracer       Tracer
+	metrics      Metrics
+	logger       log.Logger
+	panicPolicy  PanicPolicy
+	dedup        DedupStore
+	inFlight     inFlight
+	async        *asyncPublisher
 }
 
 // NewServer creates new rpc server for appServer.
 // producer will be used for sending replies.
-func NewServer(ctx context.Context, srv appServer, producer *nsq.Producer) *Server {
+func NewServer(ctx context.Context, srv appServer, producer Publisher) *Server {
 	return &Server{
 		ctx:      ctx,
 		srv:      srv,
+		handler:  srv.Serve,
 		producer: producer,
+		tracer:   noopTracer{},
+		metrics:  noopMetrics{},
+		logger:   log.Nop,
+	}
+}
+
+// SetLogger sets logger for reporting application panics, dropped and
+// expired requests and failed replies.
+func (s *Server) SetLogger(l log.Logger) {
+	if l == nil {
+		l = log.Nop
+	}
+	s.logger = l
+}
+
+// SetDedupStore enables deduplication of requests by request id.
+// Reply to the already processed request is replayed from the store instead
+// of calling application again.
+// Must be called before server receives first message.
+func (s *Server) SetDedupStore(d DedupStore) {
+	s.dedup = d
+}
+
+// SetPanicPolicy sets what to do with the message when application panics.
+// Default is PanicFinish.
+func (s *Server) SetPanicPolicy(p PanicPolicy) {
+	s.panicPolicy = p
+}
+
+// Use adds interceptors to the server. Interceptors are called in order in
+// which they are added, before application Serve.
+// Must be called before server receives first message.
+func (s *Server) Use(interceptors ...ServerInterceptor) {
+	s.interceptors = append(s.interceptors, interceptors...)
+	s.handler = chainServer(s.srv.Serve, s.interceptors)
+}
+
+// SetTracer sets tracer for request handling and reply publishing.
+// Without tracer server only puts received trace context into the
+// application context.
+// Must be called before server receives first message.
+func (s *Server) SetTracer(t Tracer) {
+	if t == nil {
+		t = noopTracer{}
 	}
+	s.tracer = t
 }
 
 // HandleMessage server side handler.
 func (s *Server) HandleMessage(m *nsq.Message) error {
+	return s.Handle(m.Body, m)
+}
+
+// Handle handles request with body, received in message m.
+// Same as nsq.Handler, m should be finished when Handle returns nil and
+// requeued on error, unless auto response is disabled by Handle.
+func (s *Server) Handle(body []byte, m Message) error {
 	fin := func() {
 		m.DisableAutoResponse()
 		m.Finish()
 	}
 	// decode message
-	req, err := Decode(m.Body)
+	req, err := Decode(body)
 	if err != nil {
+		s.logger.Log(log.LevelError, "request dropped", "error", err)
 		fin() // raise error without message requeue
 		return errors.Wrap(err, "envelope unpack failed")
 	}
 	// check expiration
 	if req.Expired() {
+		s.metrics.ServerExpired(req.Method)
+		s.logger.Log(log.LevelWarn, "request expired", "method", req.Method, "correlation_id", req.CorrelationID)
 		fin()
 		return fmt.Errorf("expired %s %d", req.Method, req.CorrelationID)
 	}
+	// check body codec
+	if err := s.checkCodec(req); err != nil {
+		s.logger.Log(log.LevelWarn, "request rejected", "method", req.Method, "correlation_id", req.CorrelationID, "error", err)
+		fin()
+		if perr := s.reply(s.ctx, req, req.Reply(nil, err)); perr != nil {
+			return perr
+		}
+		return err
+	}
+	// check whether request is already processed
+	// stream replies can't be replayed
+	dedup := s.dedup != nil && req.RequestID != "" && !req.Stream
+	if dedup {
+		if cached, ok := s.dedup.Begin(req.RequestID); !ok {
+			if cached == nil {
+				// still in progress, check again later
+				s.metrics.ServerRequeued(req.Method)
+				m.RequeueWithoutBackoff(requeueDelay)
+				return nil
+			}
+			return s.replay(req, cached)
+		}
+	}
+	// track in flight requests for Drain
+	s.inFlight.add()
+	requeued := false
+	defer func() { s.inFlight.done(requeued) }()
+	requeue := func() {
+		if dedup {
+			s.dedup.Abort(req.RequestID)
+		}
+		s.metrics.ServerRequeued(req.Method)
+		m.RequeueWithoutBackoff(requeueDelay)
+		requeued = true
+	}
+	// server is stopping, leave message to other instances
+	if s.ctx.Err() != nil {
+		requeue()
+		return nil
+	}
 	// periodically call touch on the nsq message while app is still processing it
 	defer touchMessage(s.ctx, m)()
 	// call aplication
-	appRsp, appErr := s.srv.Serve(s.ctx, req.Method, req.Body)
-	if s.ctx.Err() != nil || appErr == context.Canceled {
+	ctx := s.tracer.Extract(s.ctx, req.TraceContext())
+	ctx, r := withRequest(ctx, req)
+	ctx, span := s.tracer.StartSpan(ctx, SpanServer, "", req.Method)
+	// nobody waits for reply after request deadline
+	if d, ok := req.Deadline(); ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, d)
+		defer cancel()
+	}
+	var appRsp []byte
+	var appErr error
+	var sent uint64
+	start := time.Now()
+	if req.Stream {
+		sent, appErr = s.serveStream(ctx, req)
+	} else {
+		appRsp, appErr = s.serve(ctx, req)
+	}
+	span.End(appErr)
+	s.metrics.ServerRequest(req.Method, time.Since(start), appErr)
+	// stream can't be requeued once client received part of it
+	if sent == 0 && ((isPanic(appErr) && s.panicPolicy == PanicRequeue) ||
+		s.ctx.Err() != nil || appErr == context.Canceled) {
 		// context timeout/cancel
 		// notice that we are also requeuing on appErr == context.Cancel
 		// that's mechanism for application to postpone processing of the message
-		m.RequeueWithoutBackoff(requeueDelay)
+		requeue()
 		return nil
 	}
+	// create reply
+	rsp := req.Reply(appRsp, appErr)
+	if req.Stream {
+		rsp.Seq = sent + 1
+		rsp.EndOfStream = true
+	}
+	rsp.Headers = r.getReplyHeaders()
+	if dedup {
+		if isPanic(appErr) {
+			// let retries try again instead of replaying internal error
+			s.dedup.Abort(req.RequestID)
+		} else {
+			s.dedup.Done(req.RequestID, rsp)
+		}
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		s.metrics.ServerExpired(req.Method)
+		s.logger.Log(log.LevelWarn, "request expired while processing", "method", req.Method, "correlation_id", req.CorrelationID)
+		fin()
+		return fmt.Errorf("expired %s %d", req.Method, req.CorrelationID)
+	}
+	if s.async != nil && req.ReplyTo != "" {
+		return s.replyAsync(ctx, m, req, rsp)
+	}
+	return s.reply(ctx, req, rsp)
+}
+
+// replay sends reply of the already processed request.
+func (s *Server) replay(req, cached *Envelope) error {
+	rsp := *cached
+	// repeated request may come from other client (or restarted one)
+	rsp.ReplyTo = req.ReplyTo
+	rsp.CorrelationID = req.CorrelationID
+	rsp.Format = req.Format
+	return s.reply(s.ctx, req, &rsp)
+}
+
+// reply publishes reply to the request ReplyTo topic.
+func (s *Server) reply(ctx context.Context, req, rsp *Envelope) error {
 	// need to reply
 	if req.ReplyTo == "" {
 		return nil
 	}
-	// create reply
-	rsp := req.Reply(appRsp, appErr)
 	// send reply
-	if err := s.producer.Publish(req.ReplyTo, rsp.Encode()); err != nil {
+	_, span := s.tracer.StartSpan(ctx, SpanProducer, req.ReplyTo, req.Method)
+	err := s.producer.Publish(req.ReplyTo, rsp.Encode())
+	span.End(err)
+	if err != nil {
+		s.logger.Log(log.LevelError, "reply publish failed", "method", req.Method, "correlation_id", req.CorrelationID, "topic", req.ReplyTo, "error", err)
 		return errors.Wrap(err, "nsq publish failed")
 	}
 	return nil
 }
 
+// serve calls application through interceptors chain.
+// Recovers from panic, logs it and returns panic error.
+func (s *Server) serve(ctx context.Context, req *Envelope) (rsp []byte, err error) {
+	defer s.recover(req, &err)
+	return s.handler(ctx, req.Method, req.Body)
+}
+
+// serveStream calls streaming application, interceptors are not used.
+// Each body sent by application is published as reply with next sequence
+// number. Returns number of published replies.
+// Recovers from panic, logs it and returns panic error.
+func (s *Server) serveStream(ctx context.Context, req *Envelope) (sent uint64, err error) {
+	ss, ok := s.srv.(streamServer)
+	if !ok {
+		return 0, fmt.Errorf("streaming not supported for %s", req.Method)
+	}
+	var mu sync.Mutex
+	send := func(body []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rsp := req.Reply(body, nil)
+		rsp.Seq = sent + 1
+		if err := s.reply(ctx, req, rsp); err != nil {
+			return err
+		}
+		sent++
+		return nil
+	}
+	defer s.recover(req, &err)
+	err = ss.ServeStream(ctx, req.Method, req.Body, send)
+	return
+}
+
+// recover recovers from application panic, logs it and sets err to new panic error.
+func (s *Server) recover(req *Envelope, err *error) {
+	if r := recover(); r != nil {
+		s.logger.Log(log.LevelError, "panic in application", "method", req.Method, "correlation_id", req.CorrelationID, "panic", r, "stack", string(debug.Stack()))
+		*err = newPanicError()
+	}
+}
+
+// checkCodec rejects request with body codec different than the one
+// expected by the application.
+// Requests without codec are passed to the application.
+func (s *Server) checkCodec(req *Envelope) error {
+	c, ok := s.srv.(codecer)
+	if !ok || req.Codec == "" || req.Codec == c.Codec() {
+		return nil
+	}
+	return fmt.Errorf("unsupported codec %s for %s, expecting %s", req.Codec, req.Method, c.Codec())
+}
+
 // touchMessage to prevent auto-requeing in the nsqd
-func touchMessage(ctx context.Context, m *nsq.Message) func() {
+func touchMessage(ctx context.Context, m Message) func() {
 	ctxTouch, cancel := context.WithCancel(ctx)
 	go func() {
 		for {
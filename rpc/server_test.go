@@ -0,0 +1,160 @@
+package rpc
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/minus5/nsqm/log"
+	"github.com/nsqio/go-nsq"
+	"github.com/stretchr/testify/assert"
+)
+
+type appServerFunc func(ctx context.Context, method string, req []byte) ([]byte, error)
+
+func (f appServerFunc) Serve(ctx context.Context, method string, req []byte) ([]byte, error) {
+	return f(ctx, method, req)
+}
+
+type bufLogger struct {
+	lines []string
+}
+
+func (l *bufLogger) Log(level log.Level, msg string, fields ...interface{}) {
+	l.lines = append(l.lines, log.Format(level, msg, fields...))
+}
+
+func TestServerRecoversPanic(t *testing.T) {
+	app := appServerFunc(func(ctx context.Context, method string, req []byte) ([]byte, error) {
+		var m map[string]int
+		m["boom"]++
+		return nil, nil
+	})
+	l := &bufLogger{}
+	s := NewServer(context.Background(), app, nil)
+	s.SetLogger(l)
+
+	rsp, err := s.serve(context.Background(), &Envelope{Method: "Add", CorrelationID: 1})
+	assert.Nil(t, rsp)
+	assert.True(t, isPanic(err))
+	assert.Len(t, l.lines, 1)
+	assert.True(t, strings.HasPrefix(l.lines[0], `ERR panic in application method=Add correlation_id=1 panic="assignment to entry in nil map"`))
+	assert.Contains(t, l.lines[0], "server_test.go")
+
+	// client gets structured internal error
+	reply := (&Envelope{}).Reply(rsp, err)
+	assert.Equal(t, CodeInternal, reply.AppError.Code)
+
+	// each panic gets its own error
+	reply.AppError.WithDetail("key", "value")
+	_, err = s.serve(context.Background(), &Envelope{Method: "Add", CorrelationID: 2})
+	reply = (&Envelope{}).Reply(nil, err)
+	assert.Nil(t, reply.AppError.Details)
+}
+
+func TestServerPanicNotDeduplicated(t *testing.T) {
+	calls := 0
+	app := appServerFunc(func(ctx context.Context, method string, req []byte) ([]byte, error) {
+		calls++
+		if calls == 1 {
+			panic("boom")
+		}
+		return []byte("ok"), nil
+	})
+	var replies []*Envelope
+	p := publisherFunc(func(topic string, body []byte) error {
+		e, _ := Decode(body)
+		replies = append(replies, e)
+		return nil
+	})
+	s := NewServer(context.Background(), app, p)
+	s.SetDedupStore(NewMemoryDedupStore(10, time.Minute))
+	req := &Envelope{Method: "Add", ReplyTo: "service.rsp", RequestID: "r1"}
+
+	// internal error is not cached, retry calls application again
+	s.Handle(req.Encode(), &fakeMessage{})
+	s.Handle(req.Encode(), &fakeMessage{})
+	assert.Equal(t, 2, calls)
+	assert.Len(t, replies, 2)
+	assert.Equal(t, CodeInternal, replies[0].AppError.Code)
+	assert.Equal(t, "ok", string(replies[1].Body))
+}
+
+type msgDelegate struct {
+	finished, requeued int32
+}
+
+func (d *msgDelegate) OnFinish(m *nsq.Message) { atomic.AddInt32(&d.finished, 1) }
+func (d *msgDelegate) OnRequeue(m *nsq.Message, t time.Duration, b bool) {
+	atomic.AddInt32(&d.requeued, 1)
+}
+func (d *msgDelegate) OnTouch(m *nsq.Message) {}
+
+func newMessage(d nsq.MessageDelegate, e *Envelope) *nsq.Message {
+	var id nsq.MessageID
+	m := nsq.NewMessage(id, e.Encode())
+	m.Delegate = d
+	return m
+}
+
+func TestServerDrain(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 2)
+	app := appServerFunc(func(ctx context.Context, method string, req []byte) ([]byte, error) {
+		started <- struct{}{}
+		select {
+		case <-release:
+			return nil, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	s := NewServer(ctx, app, nil)
+	d := &msgDelegate{}
+	handle := func() { s.HandleMessage(newMessage(d, &Envelope{Method: "Add"})) }
+	go handle()
+	go handle()
+	<-started
+	<-started
+	assert.Equal(t, 2, s.InFlight())
+
+	// drain times out while requests are still processed
+	dctx, dcancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer dcancel()
+	assert.Equal(t, context.DeadlineExceeded, s.Drain(dctx))
+
+	// one completes, the other one is requeued on cancel
+	release <- struct{}{}
+	for s.InFlight() > 1 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	assert.Nil(t, s.Drain(context.Background()))
+	assert.Equal(t, 0, s.InFlight())
+	assert.Equal(t, DrainStats{Drained: 1, Requeued: 1}, s.DrainStats())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&d.requeued))
+
+	// server is stopped, new messages are requeued without calling app
+	handle()
+	assert.Equal(t, DrainStats{Drained: 1, Requeued: 2}, s.DrainStats())
+}
+
+func TestServerRequestDeadline(t *testing.T) {
+	app := appServerFunc(func(ctx context.Context, method string, req []byte) ([]byte, error) {
+		_, ok := ctx.Deadline()
+		assert.True(t, ok)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	s := NewServer(context.Background(), app, nil)
+	d := &msgDelegate{}
+	e := &Envelope{Method: "Add", ReplyTo: "service.rsp"}
+	e.SetDeadline(time.Now().Add(20 * time.Millisecond))
+	// reply is not published (producer is nil) after deadline
+	err := s.HandleMessage(newMessage(d, e))
+	assert.Contains(t, err.Error(), "expired")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&d.finished))
+}
@@ -0,0 +1,189 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// ErrStreamGap some replies of the stream are missing.
+var ErrStreamGap = errors.New("rpc stream gap")
+
+// ErrStreamNotSupported server replied to the stream request with single
+// reply without sequence number, it predates streaming.
+var ErrStreamNotSupported = errors.New("rpc server doesn't support streams")
+
+// maxStreamPending maximal number of out of order replies buffered by Stream.
+const maxStreamPending = 1024
+
+// Stream of replies to the stream request.
+// Replies are returned by Recv in order of their sequence numbers,
+// regardless of the order in which they are received.
+type Stream struct {
+	c       *Client
+	id      uint64
+	ctx     context.Context
+	span    Span
+	pending map[uint64]*Envelope
+	next    uint64
+	notify  chan struct{}
+	err     error
+	sync.Mutex
+}
+
+// CallStream sends stream request to the server and returns stream of
+// replies. Server application must implement ServeStream.
+// Call context limits duration of the whole stream. Interceptors and retry
+// policy are not used for stream calls.
+func (c *Client) CallStream(ctx context.Context, reqTopic, typ string, req []byte) (*Stream, error) {
+	ctx, span := c.tracer.StartSpan(ctx, SpanClient, reqTopic, typ)
+	eReq := c.request(ctx, typ, req)
+	eReq.Stream = true
+	id := eReq.CorrelationID
+	s := &Stream{
+		c:       c,
+		id:      id,
+		ctx:     ctx,
+		span:    span,
+		pending: make(map[uint64]*Envelope),
+		next:    1,
+		notify:  make(chan struct{}, 1),
+	}
+	c.addStream(id, s)
+	if err := c.publish(reqTopic, eReq.Encode()); err != nil {
+		err = &PublishError{Err: err}
+		s.finish(err)
+		return nil, err
+	}
+	return s, nil
+}
+
+// Recv returns body of the next reply in stream.
+// Returns io.EOF after the last reply, application error if server
+// application failed, ErrStreamGap if replies are missing or call context
+// error.
+func (s *Stream) Recv() ([]byte, error) {
+	for {
+		s.Lock()
+		if s.err != nil {
+			err := s.err
+			s.Unlock()
+			return nil, err
+		}
+		if e, ok := s.pending[s.next]; ok {
+			delete(s.pending, s.next)
+			s.next++
+			s.Unlock()
+			if e.EndOfStream {
+				setReplyHeaders(s.ctx, e.Headers)
+				return nil, s.finish(streamError(e))
+			}
+			return e.Body, nil
+		}
+		gap := len(s.pending) > 0
+		s.Unlock()
+		select {
+		case <-s.notify:
+		case <-s.ctx.Done():
+			if gap {
+				return nil, s.finish(fmt.Errorf("%w: missing reply %d", ErrStreamGap, s.next))
+			}
+			return nil, s.finish(s.ctx.Err())
+		}
+	}
+}
+
+// Close stops receiving replies. Replies which arrive later are ignored.
+func (s *Stream) Close() {
+	s.finish(context.Canceled)
+}
+
+// push adds received reply to the stream.
+// Too many out of order replies end the stream with ErrStreamGap, reply
+// without sequence number with ErrStreamNotSupported.
+func (s *Stream) push(e *Envelope) {
+	if e.Seq == 0 {
+		s.finish(ErrStreamNotSupported)
+		s.wake()
+		return
+	}
+	s.Lock()
+	if s.err != nil || e.Seq < s.next {
+		// duplicate
+		s.Unlock()
+		return
+	}
+	overflow := len(s.pending) >= maxStreamPending
+	if !overflow {
+		s.pending[e.Seq] = e
+	}
+	next := s.next
+	s.Unlock()
+	if overflow {
+		s.finish(fmt.Errorf("%w: missing reply %d", ErrStreamGap, next))
+	}
+	s.wake()
+}
+
+// wake notifies Recv waiting for replies.
+func (s *Stream) wake() {
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// finish ends stream with err, unsubscribes from client and ends span.
+// Returns stream error, first one set wins.
+func (s *Stream) finish(err error) error {
+	s.Lock()
+	first := s.err == nil
+	if first {
+		s.err = err
+	}
+	err = s.err
+	s.Unlock()
+	if first {
+		s.c.removeStream(s.id)
+		if err == io.EOF {
+			s.span.End(nil)
+		} else {
+			s.span.End(err)
+		}
+	}
+	return err
+}
+
+// streamError converts end of stream reply into Recv error.
+func streamError(e *Envelope) error {
+	if e.AppError != nil {
+		return e.AppError
+	}
+	if e.Error != "" {
+		return errors.New(e.Error)
+	}
+	return io.EOF
+}
+
+func (c *Client) addStream(id uint64, s *Stream) {
+	c.Lock()
+	defer c.Unlock()
+	c.streams[id] = s
+}
+
+func (c *Client) getStream(id uint64) (*Stream, bool) {
+	c.Lock()
+	defer c.Unlock()
+	s, ok := c.streams[id]
+	return s, ok
+}
+
+// removeStream unsubscribes stream. Replies which arrive after stream is
+// finished are handled as late replies.
+func (c *Client) removeStream(id uint64) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.streams, id)
+}
@@ -0,0 +1,166 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestStream(ctx context.Context, c *Client, id uint64) *Stream {
+	s := &Stream{
+		c:       c,
+		id:      id,
+		ctx:     ctx,
+		span:    noopSpan{},
+		pending: make(map[uint64]*Envelope),
+		next:    1,
+		notify:  make(chan struct{}, 1),
+	}
+	c.addStream(id, s)
+	return s
+}
+
+func TestStreamOrdering(t *testing.T) {
+	c := NewClient(nil, "service.req", "service.rsp")
+	s := newTestStream(context.Background(), c, 1)
+	reply := func(seq uint64, body string, eos bool) {
+		e := &Envelope{CorrelationID: 1, Seq: seq, Body: []byte(body), EndOfStream: eos, Format: FormatBinary}
+		assert.Nil(t, c.HandleMessage(newMessage(&msgDelegate{}, e)))
+	}
+	reply(2, "b", false)
+	reply(3, "", true)
+	reply(1, "a", false)
+	reply(1, "a", false) // duplicate
+
+	for _, body := range []string{"a", "b"} {
+		rsp, err := s.Recv()
+		assert.Nil(t, err)
+		assert.Equal(t, body, string(rsp))
+	}
+	_, err := s.Recv()
+	assert.Equal(t, io.EOF, err)
+	_, found := c.getStream(1)
+	assert.False(t, found)
+}
+
+func TestStreamGap(t *testing.T) {
+	c := NewClient(nil, "service.req", "service.rsp")
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	s := newTestStream(ctx, c, 1)
+	s.push(&Envelope{Seq: 1, Body: []byte("a")})
+	s.push(&Envelope{Seq: 3, EndOfStream: true})
+
+	rsp, err := s.Recv()
+	assert.Nil(t, err)
+	assert.Equal(t, "a", string(rsp))
+	_, err = s.Recv()
+	assert.True(t, errors.Is(err, ErrStreamGap))
+	// stream is unsubscribed, late replies are not delivered
+	_, found := c.getStream(1)
+	assert.False(t, found)
+	late := &Envelope{CorrelationID: 1, Seq: 2, Body: []byte("b")}
+	assert.NotNil(t, c.Handle(late.Encode(), &fakeMessage{}))
+}
+
+// recordSpan counts End calls and keeps the last error.
+type recordSpan struct {
+	ended int
+	err   error
+}
+
+func (s *recordSpan) End(err error) {
+	s.ended++
+	s.err = err
+}
+
+func TestStreamOverflow(t *testing.T) {
+	c := NewClient(nil, "service.req", "service.rsp")
+	s := newTestStream(context.Background(), c, 1)
+	span := &recordSpan{}
+	s.span = span
+	for i := 0; i <= maxStreamPending; i++ {
+		s.push(&Envelope{Seq: uint64(i + 2)})
+	}
+	_, err := s.Recv()
+	assert.True(t, errors.Is(err, ErrStreamGap))
+	assert.Equal(t, 1, span.ended)
+	assert.True(t, errors.Is(span.err, ErrStreamGap))
+	_, found := c.getStream(1)
+	assert.False(t, found)
+}
+
+func TestStreamAppError(t *testing.T) {
+	c := NewClient(nil, "service.req", "service.rsp")
+	s := newTestStream(context.Background(), c, 1)
+	appErr := NewError("not_found", "report not found")
+	eos := (&Envelope{}).Reply(nil, appErr)
+	eos.Seq, eos.EndOfStream = 1, true
+	s.push(eos)
+	_, err := s.Recv()
+	assert.Equal(t, appErr, err)
+}
+
+func TestStreamOldServer(t *testing.T) {
+	c := NewClient(nil, "service.req", "service.rsp")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	s := newTestStream(ctx, c, 1)
+	// server which ignores Stream replies once, without Seq
+	req := &Envelope{Method: "Export", ReplyTo: "service.rsp", CorrelationID: 1, Stream: true}
+	assert.Nil(t, c.Handle(req.Reply([]byte("a"), nil).Encode(), &fakeMessage{}))
+	_, err := s.Recv()
+	assert.Equal(t, ErrStreamNotSupported, err)
+	_, found := c.getStream(1)
+	assert.False(t, found)
+}
+
+type streamApp struct {
+	appServerFunc
+	items []string
+}
+
+func (a streamApp) ServeStream(ctx context.Context, method string, req []byte, send func([]byte) error) error {
+	for _, i := range a.items {
+		if err := send([]byte(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestServerServeStream(t *testing.T) {
+	var topics []string
+	var replies []*Envelope
+	p := publisherFunc(func(topic string, body []byte) error {
+		e, err := Decode(body)
+		assert.Nil(t, err)
+		topics = append(topics, topic)
+		replies = append(replies, e)
+		return nil
+	})
+	s := NewServer(context.Background(), streamApp{items: []string{"a", "b", "c"}}, p)
+	req := &Envelope{Method: "Export", ReplyTo: "client.rsp", CorrelationID: 7, Stream: true}
+	assert.Nil(t, s.Handle(req.Encode(), &fakeMessage{}))
+	assert.Equal(t, []string{"client.rsp", "client.rsp", "client.rsp", "client.rsp"}, topics)
+	for i, body := range []string{"a", "b", "c"} {
+		assert.Equal(t, uint64(7), replies[i].CorrelationID)
+		assert.Equal(t, uint64(i+1), replies[i].Seq)
+		assert.Equal(t, body, string(replies[i].Body))
+		assert.False(t, replies[i].EndOfStream)
+	}
+	assert.Equal(t, uint64(4), replies[3].Seq)
+	assert.True(t, replies[3].EndOfStream)
+
+	// app without ServeStream
+	s = NewServer(context.Background(), appServerFunc(nil), p)
+	replies = nil
+	assert.Nil(t, s.Handle(req.Encode(), &fakeMessage{}))
+	assert.Len(t, replies, 1)
+	assert.True(t, replies[0].EndOfStream)
+	assert.NotEmpty(t, replies[0].Error)
+}
@@ -0,0 +1,105 @@
+package rpc
+
+import (
+	"context"
+	"encoding/hex"
+	"strings"
+)
+
+// TraceContext W3C trace context (https://www.w3.org/TR/trace-context/)
+// transferred in the envelope.
+type TraceContext struct {
+	TraceParent string
+	TraceState  string
+}
+
+// Valid reports whether TraceParent is well formed traceparent value:
+// version-traceid-parentid-flags, with non zero trace and parent id.
+func (t TraceContext) Valid() bool {
+	p := strings.Split(t.TraceParent, "-")
+	if len(p) < 4 || len(p[0]) != 2 || p[0] == "ff" {
+		return false
+	}
+	if p[0] == "00" && len(p) != 4 {
+		return false
+	}
+	return isHex(p[0], 2) &&
+		isHex(p[1], 32) && strings.Trim(p[1], "0") != "" &&
+		isHex(p[2], 16) && strings.Trim(p[2], "0") != "" &&
+		isHex(p[3], 2)
+}
+
+func isHex(s string, l int) bool {
+	if len(s) != l || strings.ToLower(s) != s {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// WithTraceContext returns context carrying trace context.
+// Client sends it in the request envelope when no Tracer is set.
+func WithTraceContext(ctx context.Context, tc TraceContext) context.Context {
+	return context.WithValue(ctx, traceKey, tc)
+}
+
+// TraceContextFromContext returns trace context set by WithTraceContext.
+// On the server side that is trace context received with the request, so
+// calls made from the application with the same context continue the trace.
+func TraceContextFromContext(ctx context.Context) TraceContext {
+	tc, _ := ctx.Value(traceKey).(TraceContext)
+	return tc
+}
+
+// SpanKind role of the span in the rpc call.
+type SpanKind int
+
+// Span kinds.
+const (
+	// SpanClient client call, from request publish to reply receive
+	SpanClient SpanKind = iota
+	// SpanServer application handling request on the server side
+	SpanServer
+	// SpanProducer publishing reply on the server side
+	SpanProducer
+)
+
+// Tracer creates spans for rpc operations and propagates trace context
+// through the envelope. See rpc/otel for OpenTelemetry implementation.
+type Tracer interface {
+	// StartSpan starts span of kind for method on topic.
+	// Returns context which carries new span.
+	StartSpan(ctx context.Context, kind SpanKind, topic, method string) (context.Context, Span)
+	// Inject returns trace context of the current span in ctx.
+	Inject(ctx context.Context) TraceContext
+	// Extract returns context with remote span from tc.
+	Extract(ctx context.Context, tc TraceContext) context.Context
+}
+
+// Span single traced operation.
+type Span interface {
+	// End finishes span, err is operation result.
+	End(err error)
+}
+
+// noopTracer propagates trace context without creating spans.
+type noopTracer struct{}
+
+func (noopTracer) StartSpan(ctx context.Context, kind SpanKind, topic, method string) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+
+func (noopTracer) Inject(ctx context.Context) TraceContext {
+	return TraceContextFromContext(ctx)
+}
+
+func (noopTracer) Extract(ctx context.Context, tc TraceContext) context.Context {
+	if !tc.Valid() {
+		return ctx
+	}
+	return WithTraceContext(ctx, tc)
+}
+
+type noopSpan struct{}
+
+func (noopSpan) End(err error) {}
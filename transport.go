@@ -0,0 +1,75 @@
+package nsqm
+
+import (
+	"github.com/minus5/nsqm/rpc"
+	nsq "github.com/nsqio/go-nsq"
+)
+
+// Producer publishes messages, *nsq.Producer or producer of the Transport.
+// Producer may implement optional rpc.MultiPublisher, rpc.DeferredPublisher
+// and rpc.AsyncPublisher used for batching, deferred and async publishing.
+type Producer interface {
+	rpc.Publisher
+	Stop()
+}
+
+// Consumer receives messages from topic channel.
+type Consumer interface {
+	Stop()
+	// Done is closed when consumer is stopped.
+	Done() <-chan int
+}
+
+// Transport creates producers and consumers used by rpc clients and servers
+// instead of connecting to nsqd. See memory.Broker for in process transport.
+type Transport interface {
+	NewProducer() (Producer, error)
+	NewConsumer(topic, channel string, handler nsq.Handler, concurrency int) (Consumer, error)
+}
+
+// nsqConsumer adds Done to nsq.Consumer.
+type nsqConsumer struct {
+	*nsq.Consumer
+}
+
+func (c nsqConsumer) Done() <-chan int {
+	return c.StopChan
+}
+
+// nsqProducer adapts nsq.Producer PublishAsync to rpc.AsyncPublisher.
+type nsqProducer struct {
+	*nsq.Producer
+}
+
+func (p nsqProducer) PublishAsync(topic string, body []byte, done func(error)) error {
+	ch := make(chan *nsq.ProducerTransaction, 1)
+	if err := p.Producer.PublishAsync(topic, body, ch); err != nil {
+		return err
+	}
+	go func() { done((<-ch).Error) }()
+	return nil
+}
+
+// newProducer creates producer of the Config transport or nsq producer.
+func newProducer(cfg *Config) (Producer, error) {
+	if cfg.Transport != nil {
+		return cfg.Transport.NewProducer()
+	}
+	p, err := NewProducer(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return nsqProducer{p}, nil
+}
+
+// newConsumer creates consumer of the Config transport or nsq consumer.
+func newConsumer(cfg *Config, topic, channel string, handler nsq.Handler) (Consumer, error) {
+	if cfg.Transport != nil {
+		return cfg.Transport.NewConsumer(topic, channel, handler, cfg.Concurrency)
+	}
+	c, err := NewConsumer(cfg, topic, channel, handler)
+	if err != nil {
+		return nil, err
+	}
+	return nsqConsumer{c}, nil
+}